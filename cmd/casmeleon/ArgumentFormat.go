@@ -2,14 +2,26 @@ package main
 
 import (
 	"github.com/aleferri/casmeleon/pkg/asm"
+	"github.com/aleferri/casmeleon/pkg/text"
 )
 
 type ArgumentFormat struct {
 	types      []uint32
 	format     []uint32
 	parameters []asm.Symbol
+	symbols    []text.Symbol //source token of every parameter
+	members    []bool        //parameters that are set members, their value depends on the set of the opcode
 }
 
 func MakeFormat() ArgumentFormat {
-	return ArgumentFormat{types: []uint32{}, format: []uint32{}, parameters: []asm.Symbol{}}
+	return ArgumentFormat{types: []uint32{}, format: []uint32{}, parameters: []asm.Symbol{}, symbols: []text.Symbol{}, members: []bool{}}
+}
+
+// Operands are the source text of the parameters, in order
+func (a ArgumentFormat) Operands() []string {
+	operands := make([]string, len(a.symbols))
+	for i, s := range a.symbols {
+		operands[i] = s.Value()
+	}
+	return operands
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aleferri/casmeleon/pkg/asm"
+	"github.com/aleferri/casmeleon/pkg/text"
+)
+
+//AssemblyError is an error or a warning raised by the body of an opcode while
+//assembling a source line, located at the operand reported by the statement
+type AssemblyError struct {
+	message  string
+	source   *text.Source
+	at       text.Symbol
+	pass     int
+	value    int64
+	hasValue bool
+	warning  bool   //raised by .warning, the assembly goes on
+	opcode   string //name of the opcode that raised it
+	origin   string //inline that raised it, if any
+}
+
+func (e *AssemblyError) Error() string {
+	fileName, line, column := e.source.FindPosition(e.at)
+	inline := ""
+	if e.origin != "" {
+		inline = "inline " + e.origin + ", "
+	}
+	if e.warning {
+		//warnings are kept from the pass that last assembled the line, the pass number means nothing
+		return fmt.Sprintf("%s:%d:%d: warning: %s (%svalue %d)", fileName, line+1, column+1, e.message, inline, e.value)
+	}
+	msg := fmt.Sprintf("%s:%d:%d: %s (%spass %d", fileName, line+1, column+1, e.message, inline, e.pass)
+	if e.hasValue {
+		msg += fmt.Sprintf(", value %d", e.value)
+	}
+	return msg + ")"
+}
+
+//PrettyPrint the error followed by the source line, with the operand underlined
+func (e *AssemblyError) PrettyPrint() {
+	fmt.Println(e.Error())
+	e.source.PrintContext(text.MakeMessageContext(e.at, "\n", "\n"))
+}
+
+//location of the error as file:line, warnings are reported once per location and message
+func (e *AssemblyError) location() string {
+	fileName, line, _ := e.source.FindPosition(e.at)
+	return fmt.Sprintf("%s:%d", fileName, line+1)
+}
+
+//WarningPolicy decides which warnings are reported and whether they fail the assembly
+type WarningPolicy struct {
+	asErrors bool     //-Werror
+	disabled []string //-Wno-<selector>, by opcode or inline name or by message
+}
+
+//ParseWarningFlags remove -Werror and -Wno-<selector> from args, the flag package
+//cannot declare a flag for every selector
+func ParseWarningFlags(args []string) (WarningPolicy, []string) {
+	policy := WarningPolicy{}
+	rest := []string{}
+	for _, a := range args {
+		switch {
+		case a == "-Werror" || a == "--Werror":
+			policy.asErrors = true
+		case strings.HasPrefix(a, "-Wno-"):
+			policy.disabled = append(policy.disabled, strings.TrimPrefix(a, "-Wno-"))
+		default:
+			rest = append(rest, a)
+		}
+	}
+	return policy, rest
+}
+
+//Enabled is false if a selector matches the opcode or the inline name or is part of the message
+func (p WarningPolicy) Enabled(w *AssemblyError) bool {
+	for _, sel := range p.disabled {
+		if strings.EqualFold(sel, w.opcode) || strings.EqualFold(sel, w.origin) || strings.Contains(strings.ToLower(w.message), strings.ToLower(sel)) {
+			return false
+		}
+	}
+	return true
+}
+
+//CollectWarnings from the final pass, in program order, once per source line and message
+func CollectWarnings(list []asm.Compilable, policy WarningPolicy) []*AssemblyError {
+	seen := map[string]bool{}
+	found := []*AssemblyError{}
+	for _, item := range list {
+		instance, ok := item.(*OpcodeInstance)
+		if !ok {
+			continue
+		}
+		for _, w := range instance.Warnings() {
+			key := w.location() + "\x00" + w.message
+			if seen[key] || !policy.Enabled(w) {
+				continue
+			}
+			seen[key] = true
+			found = append(found, w)
+		}
+	}
+	return found
+}
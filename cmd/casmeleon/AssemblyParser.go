@@ -184,9 +184,14 @@ func TokensToFormat(lang casm.Language, symTable *SymbolTable, tokens []text.Sym
 				return args, casm.WrapMatchError(matchErr, "\n", "\n")
 			}
 			args.parameters = append(args.parameters, asm.MakeConstant(numVal))
+			args.symbols = append(args.symbols, tok)
+			args.members = append(args.members, false)
 		} else if tok.ID() == text.Identifier {
+			//the value of a register depends on the set of the opcode that accepts it,
+			//the one of the last set that contains it is only a placeholder
 			setName, found := lang.SetOf(tok.Value())
-			if found && setName.ID() > 1 {
+			isMember := found && setName.ID() > 1
+			if isMember {
 				args.types = append(args.types, setName.ID())
 				setValue, _ := setName.Value(tok.Value())
 				args.parameters = append(args.parameters, asm.MakeConstant(int64(setValue)))
@@ -204,6 +209,8 @@ func TokensToFormat(lang casm.Language, symTable *SymbolTable, tokens []text.Sym
 				args.types = append(args.types, numSet.ID())
 			}
 			args.format = append(args.format, text.Identifier)
+			args.symbols = append(args.symbols, tok)
+			args.members = append(args.members, isMember)
 		} else {
 			args.format = append(args.format, tok.ID())
 		}
@@ -211,6 +218,61 @@ func TokensToFormat(lang casm.Language, symTable *SymbolTable, tokens []text.Sym
 	return args, nil
 }
 
+//NoMatchingOpcode build the error for a source line that no opcode accepts. If the
+//mnemonic exists the error lists the operands as they were understood and every form
+//of the mnemonic, marking where each one stops matching; otherwise it suggests the
+//closest mnemonic, if any.
+func NoMatchingOpcode(lang casm.Language, name text.Symbol, tokens []text.Symbol, args ArgumentFormat) error {
+	forms := lang.FilterOpcodesByName(name.Value()).Candidates()
+	if len(forms) == 0 {
+		matchErr := parser.ExpectedAnyOf(name, "Unknown opcode '%s', was expecting a valid %s", text.Identifier)
+		parseErr := casm.WrapMatchError(matchErr, name.Value(), "\n").(*casm.ParserError)
+		if suggestion, found := lang.SuggestOpcode(name.Value()); found {
+			parseErr.AddNote("did you mean '" + suggestion + "'?")
+		}
+		return parseErr
+	}
+
+	matchErr := parser.ExpectedAnyOf(name, "No form of '%s' accepts these operands, was expecting a valid %s", text.Identifier)
+	parseErr := casm.WrapMatchError(matchErr, name.Value(), "\n").(*casm.ParserError)
+
+	sourceDesc := casm.StringifyFormat(&lang, args.format, args.types)
+	operands := []string{}
+	for i, tok := range tokens {
+		if args.format[i] == text.Identifier {
+			operands = append(operands, tok.Value()+":"+sourceDesc[i])
+		} else {
+			operands = append(operands, tok.Value())
+		}
+	}
+	parseErr.AddNote("operands: " + name.Value() + " " + strings.Join(operands, " "))
+	parseErr.AddNote("candidates:")
+
+	listed := map[string]bool{}
+	for _, op := range forms {
+		desc := op.StringifyFormat(&lang)
+		line := "    " + op.Name()
+		column := -1
+		mismatch := op.FirstMismatch(args.format, args.types, args.Operands())
+		for i, particle := range desc {
+			if i == mismatch {
+				column = len(line) + 1
+			}
+			line += " " + particle
+		}
+		if column < 0 {
+			column = len(line) + 1
+		}
+		if listed[line] {
+			continue
+		}
+		listed[line] = true
+		parseErr.AddNote(line)
+		parseErr.AddNote(strings.Repeat(" ", column) + "^")
+	}
+	return parseErr
+}
+
 func ParseSourceLine(lang casm.Language, stream parser.Stream, table *SymbolTable, prog *AssemblyProgram) error {
 	parser.ConsumeAll(stream, text.EOL)
 	if stream.Peek().ID() == text.EOF {
@@ -242,21 +304,28 @@ func ParseSourceLine(lang casm.Language, stream parser.Stream, table *SymbolTabl
 
 		win := lang.FilterOpcodesByName(name.Value())
 
+		//the symbols of a rejected line are not reported as undefined too
+		mark := len(table.watchList)
 		args, literalErrs := TokensToFormat(lang, table, tokensFormat)
 
 		if literalErrs != nil {
+			table.UnWatchFrom(mark)
 			return literalErrs
 		}
 
-		win = win.FilterByFormat(args.format, args.types)
+		win = win.FilterByFormat(args.format, args.types, args.Operands())
 
-		op, err := win.PickFirst()
-		if err != nil {
-			matchErr := parser.ExpectedAnyOf(name, "Expected valid opcode, but %s was found, unrecognized %s", text.Identifier)
-			return casm.WrapMatchError(matchErr, name.Value(), "\n")
+		//every candidate goes to the instance: which one is best depends on
+		//the values of the operands, known only while assembling
+		candidates := win.Candidates()
+		if len(candidates) == 0 {
+			table.UnWatchFrom(mark)
+			return NoMatchingOpcode(lang, name, tokensFormat, args)
 		}
 
-		prog.Add(MakeOpcodeInstance(op, args, table, lang.ByteSize()/8, lang.IsBigEndian()))
+		inst := MakeOpcodeInstance(candidates, args, table, lang.ByteSize()/8, lang.IsBigEndian())
+		inst.LocateIn(stream.Source(), name)
+		prog.Add(inst)
 
 		return nil
 	}
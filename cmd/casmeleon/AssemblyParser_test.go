@@ -2,12 +2,17 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/aleferri/casmeleon/internal/casm"
 	"github.com/aleferri/casmeleon/pkg/asm"
+	"github.com/aleferri/casmeleon/pkg/parser"
 	"github.com/aleferri/casmeleon/pkg/text"
 	"github.com/aleferri/casmvm/pkg/vmex"
 	"github.com/aleferri/casmvm/pkg/vmio"
@@ -95,3 +100,663 @@ func TestCasmProcessing(t *testing.T) {
 		t.Error(compilingErr.Error())
 	}
 }
+
+// buildTestLanguage from the text of a .casm file
+func buildTestLanguage(name string, reader *bufio.Reader) (casm.Language, error) {
+	repo := text.BuildSource(name)
+	root, err := casm.ParseCasm(casm.BuildStream(reader, &repo), repo)
+	if err != nil {
+		return casm.Language{}, err
+	}
+	return casm.MakeLanguage(root, 8)
+}
+
+// expectLanguageErrors build the language of every case, by name, each one must fail
+func expectLanguageErrors(t *testing.T, cases map[string]string) {
+	for name, src := range cases {
+		if _, err := buildTestLanguage(name, bufio.NewReader(strings.NewReader(src))); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
+
+// loadTestLanguage from a .casm file of the tests folder
+func loadTestLanguage(t *testing.T, langFile string) casm.Language {
+	root, _, err := casm.LoadCasm("../../tests/" + langFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	lang, err := casm.MakeLanguage(root, 8)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	SetNumberPrefixes(lang.NumberPrefixes())
+	return lang
+}
+
+// assembleTestSource assembles a source file of the tests folder, returning the error of the assembly
+func assembleTestSource(t *testing.T, lang casm.Language, sourceFile string) ([]uint8, *AssemblyProgram, error) {
+	program, asmErr := ParseASMFile(lang, "../../tests/"+sourceFile)
+	if asmErr != nil {
+		t.Fatal(asmErr.Error())
+	}
+
+	log := vmio.MakeVMLoggerConsole(vmio.ALL)
+	ex := vmex.MakeInterpreter(lang.Executables(), log, vmex.MakeVMFrame())
+	bin, compilingErr := asm.AssembleSource(ex, program.list, asm.MakeSourceContext(8))
+	return bin, program, compilingErr
+}
+
+// assembleTestFiles assembles a source file of the tests folder with a language of the same folder
+func assembleTestFiles(t *testing.T, langFile string, sourceFile string) ([]uint8, *AssemblyProgram) {
+	bin, program, err := assembleTestSource(t, loadTestLanguage(t, langFile), sourceFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return bin, program
+}
+
+// expectBytes compare the output with the expected bytes
+func expectBytes(t *testing.T, bin []uint8, expected []uint8) {
+	if len(bin) != len(expected) {
+		t.Fatalf("Expected %d bytes, found %d", len(expected), len(bin))
+	}
+	for i, b := range expected {
+		if bin[i] != b {
+			t.Errorf("Byte %d: expected %X, found %X", i, b, bin[i])
+		}
+	}
+}
+
+func TestBestCandidate(t *testing.T) {
+	bin, _ := assembleTestFiles(t, "best_match/zp.casm", "best_match/zp.s")
+
+	expected := []uint8{0xA5, 0x07, 0xAD, 0x20, 0x01, 0xA5, 0x10, 0xEA}
+	if len(bin) != 0x121 {
+		t.Fatalf("Expected %d bytes, found %d", 0x121, len(bin))
+	}
+	expectBytes(t, bin[:len(expected)], expected)
+
+	//a form that stops being required after the first pass cannot be replaced by a shorter one
+	_, _, err := assembleTestSource(t, loadTestLanguage(t, "best_match/shrink.casm"), "best_match/shrink.s")
+	if err == nil || !strings.Contains(err.Error(), "No form of PAD keeps the 3 byte(s) of the previous pass, the longest that succeeds takes 1") {
+		t.Errorf("Expected PAD to be unable to shrink, found %v", err)
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	bin, program := assembleTestFiles(t, "warnings/warn.casm", "warnings/warn.s")
+	expectBytes(t, bin, []uint8{0x90, 0x00, 0x90, 0xFF, 0x90, 0x03, 0x01})
+
+	all := CollectWarnings(program.list, WarningPolicy{})
+	if len(all) != 2 {
+		t.Fatalf("Expected 2 warnings, found %d", len(all))
+	}
+	if all[0].Error() != "../../tests/warnings/warn.s:1:18: warning: loading zero, use CLR (value 0)" {
+		t.Errorf("Unexpected first warning: %s", all[0].Error())
+	}
+	if all[1].value != 511 || all[1].origin != "LO" {
+		t.Errorf("Unexpected second warning: %s", all[1].Error())
+	}
+
+	_, args := ParseWarningFlags([]string{"-Wno-LO", "-lang=x"})
+	if len(args) != 1 {
+		t.Errorf("Expected -Wno-LO to be removed from the arguments")
+	}
+	filtered := CollectWarnings(program.list, WarningPolicy{disabled: []string{"lo", "use clr"}})
+	if len(filtered) != 0 {
+		t.Errorf("Expected no warnings, found %d", len(filtered))
+	}
+}
+
+// captureOutput of f, written on the standard output
+func captureOutput(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	f()
+	os.Stdout = stdout
+	w.Close()
+	out, _ := ioutil.ReadAll(r)
+	return string(out)
+}
+
+func TestErrorTrace(t *testing.T) {
+	lang := loadTestLanguage(t, "signals/signals.casm")
+	cases := []struct {
+		source   string
+		expected string
+	}{
+		//the same message is raised by both operands, the second one fails
+		{"signals/operand.s", "../../tests/signals/operand.s:1:20: out of range (pass 1, value 300)\n        ADD     1, 300\n-------------------^^^\n"},
+		{"signals/inline.s", "../../tests/signals/inline.s:1:9: out of range (inline CHECK, pass 1, value 9)\n        BIT     9\n--------^^^------\n"},
+	}
+	for _, c := range cases {
+		_, _, err := assembleTestSource(t, lang, c.source)
+		traced, ok := err.(*AssemblyError)
+		if !ok {
+			t.Errorf("%s: expected an assembly error, found %v", c.source, err)
+			continue
+		}
+		if out := captureOutput(t, traced.PrettyPrint); out != c.expected {
+			t.Errorf("%s: expected\n%s\nfound\n%s", c.source, c.expected, out)
+		}
+	}
+}
+
+func TestLocalVariables(t *testing.T) {
+	bin, _ := assembleTestFiles(t, "locals/locals.casm", "locals/locals.s")
+	expectBytes(t, bin, []uint8{0x46, 0x00, 0x80, 0xFC, 0x80, 0x00, 0x41})
+
+	expectLanguageErrors(t, map[string]string{
+		"redeclared":   ".opcode A {{ }} .with ( ) -> { .let x = 1; .let x = 2; .out [ x ]; }",
+		"parameter":    ".opcode A {{ k }} .with ( k : Ints ) -> { k = 1; .out [ k ]; }",
+		"undeclared":   ".opcode A {{ }} .with ( ) -> { x = 1; .out [ x ]; }",
+		"out of scope": ".opcode A {{ k }} .with ( k : Ints ) -> { .if k { .let x = 1; } .out [ x ]; }",
+	})
+}
+
+func TestLoops(t *testing.T) {
+	lang := loadTestLanguage(t, "loops/loops.casm")
+	bin, _, err := assembleTestSource(t, lang, "loops/loops.s")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectBytes(t, bin, []uint8{0x50, 0x52, 0x57, 0xAC, 0x02, 0x05, 0xEE, 0xEE, 0xEE, 0x00, 0x01, 0x11, 0xFF})
+
+	_, _, err = assembleTestSource(t, lang, "loops/limit.s")
+	if err == nil || !strings.Contains(err.Error(), "exceeded its limit of 4 iterations") {
+		t.Errorf("Expected the loop to exceed its limit, found %v", err)
+	}
+
+	expectLanguageErrors(t, map[string]string{
+		"unbounded": ".opcode A {{ n }} .with ( n : Ints ) -> { .for i in 0..n { .emit i; } }",
+		"no limit":  ".opcode A {{ n }} .with ( n : Ints ) -> { .while n { .emit n; } }",
+		"assigned":  ".opcode A {{ }} .with ( ) -> { .for i in 0..2 { i = 3; } }",
+		"no range":  ".opcode A {{ }} .with ( ) -> { .for i in 8 { .emit i; } }",
+		"big limit": ".opcode A {{ n }} .with ( n : Ints ) -> { .while n .limit 100000 { .emit n; } }",
+		"big range": ".opcode A {{ }} .with ( ) -> { .for i in 0..100000 { .emit i; } }",
+		"parameter": ".opcode A {{ i }} .with ( i : Ints ) -> { .for i in 0..2 { .emit i; } }",
+	})
+
+	//the inner body would be copied 40000 times, the copies of nested loops multiply
+	nested := ".opcode M {{ n }} .with ( n : Ints ) -> { .for i in 0..n .limit 200 { .for j in 0..i .limit 200 { .emit j; } } }"
+	_, err = buildTestLanguage("nested", bufio.NewReader(strings.NewReader(nested)))
+	if err == nil || !strings.Contains(err.Error(), "The loop is copied 40000 times once unrolled") {
+		t.Errorf("Expected the nested loops to exceed the copies, found %v", err)
+	}
+	nested = ".opcode M {{ n }} .with ( n : Ints ) -> { .for i in 0..4 { .for j in 0..n .limit 256 { .emit j; } } }"
+	_, err = buildTestLanguage("nested", bufio.NewReader(strings.NewReader(nested)))
+	if err != nil {
+		t.Errorf("Expected 1024 copies of the nested loops to compile, found %v", err)
+	}
+
+	//1000 copies of a body that needs 100 locals are more than the 16 bits of their numbers
+	long := ".opcode M {{ n }} .with ( n : Ints ) -> { .let k = n; .while k .limit 1000 { k = k" + strings.Repeat(" * n", 100) + "; } }"
+	_, err = buildTestLanguage("long", bufio.NewReader(strings.NewReader(long)))
+	if err == nil || !strings.Contains(err.Error(), "The loop needs more than 65535 locals once unrolled") {
+		t.Errorf("Expected the loop to run out of locals, found %v", err)
+	}
+}
+
+func TestEmit(t *testing.T) {
+	bin, _ := assembleTestFiles(t, "emit/emit.casm", "emit/emit.s")
+	expectBytes(t, bin, []uint8{
+		0x8B, 0x0F, 0x26, 0x8B, 0x57, 0x05, 0x2E, 0x8B, 0x87, 0x34, 0x12, 0x36, 0x50, 0x00, 0x50, 0x00,
+	})
+
+	expectLanguageErrors(t, map[string]string{
+		"out in inline": ".inline F .with ( a : Ints ) -> { .out [ a ]; }",
+		"outr emitting": ".inline F .with ( a : Ints ) -> { .emit a; .return a; } " +
+			".opcode A {{ k }} .with ( k : Ints ) -> { .outr [ k, .expr F(k) ]; }",
+	})
+}
+
+func TestBitFields(t *testing.T) {
+	lang := loadTestLanguage(t, "bits/bits.casm")
+	bin, _, err := assembleTestSource(t, lang, "bits/bits.s")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectBytes(t, bin, []uint8{0xFF, 0xC1, 0x00, 0x93, 0xFF, 0xC1, 0x00, 0x93, 0x07, 0xA5})
+
+	_, _, err = assembleTestSource(t, lang, "bits/overflow.s")
+	if err == nil || !strings.Contains(err.Error(), "imm does not fit in a field of 12 bits") {
+		t.Errorf("Expected an overflow of the field imm, found %v", err)
+	}
+
+	expectLanguageErrors(t, map[string]string{
+		"short fields": ".opcode A {{ k }} .with ( k : Ints ) -> { .bits 16 [ k : 4, 0 : 4 ]; }",
+		"odd word":     ".opcode A {{ k }} .with ( k : Ints ) -> { .bits 12 [ k : 12 ]; }",
+		"wide word":    ".opcode A {{ k }} .with ( k : Ints ) -> { .bits 72 [ k : 72 ]; }",
+		"bad order":    ".opcode A {{ k }} .with ( k : Ints ) -> { .bits 8 middle [ k : 8 ]; }",
+	})
+}
+
+func TestOutputWidths(t *testing.T) {
+	bin, _ := assembleTestFiles(t, "atom/mixed.casm", "atom/mixed.s")
+	expectBytes(t, bin, []uint8{0x66, 0xB9, 0x34, 0x12, 0xBB, 0x44, 0x33, 0x22, 0x11, 0xEA, 0x0A, 0x0B, 0x0C, 0x68, 0x55, 0x66})
+
+	lang := loadTestLanguage(t, "atom/words.casm")
+	if lang.ByteSize() != 16 {
+		t.Fatalf("Expected atoms of 16 bits, found %d", lang.ByteSize())
+	}
+	bin, _, err := assembleTestSource(t, lang, "atom/words.s")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectBytes(t, bin, []uint8{0x12, 0x34, 0xCC, 0xDD, 0xAA, 0xBB})
+
+	expectLanguageErrors(t, map[string]string{
+		"bad atom":     ".atom 12;",
+		"two atoms":    ".atom 8; .atom 16;",
+		"partial atom": ".atom 16; .opcode A {{ k }} .with ( k : Ints ) -> { .out [ k : 24 ]; }",
+		"bad order":    ".opcode A {{ k }} .with ( k : Ints ) -> { .out [ k : 16 middle ]; }",
+		"wide value":   ".opcode A {{ k }} .with ( k : Ints ) -> { .emit k : 72; }",
+	})
+}
+
+func TestLayout(t *testing.T) {
+	lang := loadTestLanguage(t, "layout/little.casm")
+	if lang.ByteSize() != 16 || lang.IsBigEndian() {
+		t.Fatalf("Expected little endian atoms of 16 bits, found %d bits, big endian %v", lang.ByteSize(), lang.IsBigEndian())
+	}
+	bin, _, err := assembleTestSource(t, lang, "layout/little.s")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectBytes(t, bin, []uint8{0x34, 0x12, 0xDD, 0xCC, 0xBB, 0xAA})
+
+	parse := func(src string) parser.CSTNode {
+		repo := text.BuildSource("layout")
+		root, parseErr := casm.ParseCasm(casm.BuildStream(bufio.NewReader(strings.NewReader(src)), &repo), repo)
+		if parseErr != nil {
+			t.Fatal(parseErr.Error())
+		}
+		return root
+	}
+
+	root := parse(".endian little; .atom 16;")
+	layout, warnings, err := ResolveLayout(root, map[string]bool{}, 8, "big")
+	if err != nil || layout.ByteSize != 16 || layout.BigEndian || len(warnings) != 0 {
+		t.Errorf("Expected the layout of the file without warnings, found %v %v %v", layout, warnings, err)
+	}
+	layout, warnings, err = ResolveLayout(root, map[string]bool{"byteSize": true, "endian": true}, 8, "big")
+	if err != nil || layout.ByteSize != 8 || !layout.BigEndian || len(warnings) != 2 {
+		t.Errorf("Expected the flags to override the file with 2 warnings, found %v %v %v", layout, warnings, err)
+	}
+	layout, warnings, err = ResolveLayout(root, map[string]bool{"byteSize": true, "endian": true}, 16, "little")
+	if err != nil || layout.ByteSize != 16 || layout.BigEndian || len(warnings) != 0 {
+		t.Errorf("Expected the flags that agree with the file to pass without warnings, found %v %v %v", layout, warnings, err)
+	}
+	layout, warnings, err = ResolveLayout(parse(""), map[string]bool{"endian": true}, 8, "little")
+	if err != nil || layout.ByteSize != 8 || layout.BigEndian || len(warnings) != 0 {
+		t.Errorf("Expected the flags to set the layout without warnings, found %v %v %v", layout, warnings, err)
+	}
+	if _, _, err = ResolveLayout(root, map[string]bool{"byteSize": true}, 12, "big"); err == nil {
+		t.Errorf("Expected an error for -byteSize=12")
+	}
+
+	expectLanguageErrors(t, map[string]string{
+		"bad endian": ".endian middle;",
+		"two endian": ".endian big; .endian little;",
+		"bad byte":   ".byte 7;",
+		"atom byte":  ".atom 8; .byte 16;",
+	})
+}
+
+func TestSetValues(t *testing.T) {
+	bin, _ := assembleTestFiles(t, "sets/regs.casm", "sets/regs.s")
+	expectBytes(t, bin, []uint8{0xC0, 0x01, 0xC0, 0x0D, 0xC0, 0x0D, 0xC0, 0x0E, 0xC0, 0x1D, 0xD0, 0x0F})
+
+	expectLanguageErrors(t, map[string]string{
+		"duplicate":        ".set A { X; Y; X = 4; }",
+		"duplicate nocase": ".set A nocase { X; x; }",
+		"bad option":       ".set A sorted { X; }",
+		"missing value":    ".set A { X = ; }",
+		"huge value":       ".set A { X = 0x7FFFFFFF; Y; }",
+	})
+}
+
+func TestSetComposition(t *testing.T) {
+	lang := loadTestLanguage(t, "sets/classes.casm")
+	bin, _, err := assembleTestSource(t, lang, "sets/classes.s")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectBytes(t, bin, []uint8{0x06, 0xF0, 0x52, 0xF0, 0xD7, 0x51, 0x56})
+
+	expectLanguageErrors(t, map[string]string{
+		"not a member":    ".set A { X; Y; } .set B : A { Z; }",
+		"subset value":    ".set A { X; Y; } .set B : A { X = 3; }",
+		"unknown parent":  ".set B : A { X; }",
+		"builtin parent":  ".set B : Ints { X; }",
+		"ambiguous union": ".set A { X; Y; } .set B { Y; } .set C = A | B;",
+		"mixed case":      ".set A nocase { X; } .set B { Y; } .set C = A | B;",
+		"unknown part":    ".set A { X; } .set C = A | B;",
+	})
+}
+
+func TestSharedMember(t *testing.T) {
+	bin, _ := assembleTestFiles(t, "sets/shared.casm", "sets/shared.s")
+	expectBytes(t, bin, []uint8{0x79, 0x7B, 0x78, 0x7A})
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	lang := loadTestLanguage(t, "case/nocase.casm")
+	if !lang.IsCaseInsensitive() || !lang.LabelsIgnoreCase() {
+		t.Fatalf("Expected a case insensitive language with case insensitive labels")
+	}
+	bin, _, err := assembleTestSource(t, lang, "case/nocase.s")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectBytes(t, bin, []uint8{0xA9, 0x1F, 0xA9, 0x20, 0xA9, 0x05, 0xE2, 0xE1, 0x4C, 0x00})
+
+	//the forward reference is spelled differently from the label, it must still follow it
+	bin, _, err = assembleTestSource(t, lang, "case/forward.s")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectBytes(t, bin, []uint8{0x4C, 0x10, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x4C, 0x10})
+
+	src := ".set Regs { A; } .opcode LDA {{ r }} .with ( r : Regs ) -> { .out [ r ]; }"
+	sensitive, err := buildTestLanguage("sensitive", bufio.NewReader(strings.NewReader(src)))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(sensitive.FilterOpcodesByName("lda").Candidates()) != 0 {
+		t.Errorf("Expected lda to be unknown in a case sensitive language")
+	}
+	if set, found := sensitive.SetOf("a"); found && set.ID() > 1 {
+		t.Errorf("Expected a not to be a member of Regs in a case sensitive language")
+	}
+
+	expectLanguageErrors(t, map[string]string{
+		"bad case":    ".case upper;",
+		"bad option":  ".case insensitive opcodes;",
+		"sensitive +": ".case sensitive labels;",
+	})
+}
+
+func TestOptionalOperands(t *testing.T) {
+	lang := loadTestLanguage(t, "optional/z80.casm")
+	if forms := len(lang.FilterOpcodesByName("JP").Candidates()); forms != 3 {
+		t.Errorf("Expected 3 forms of JP, found %d", forms)
+	}
+	bin, _, err := assembleTestSource(t, lang, "optional/z80.s")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectBytes(t, bin, []uint8{0xC9, 0xC8, 0xDD, 0x7E, 0x00, 0xFD, 0x7E, 0x05, 0xC3, 0x10, 0xC3, 0x12, 0xC3, 0x16})
+
+	expectLanguageErrors(t, map[string]string{
+		"no default":     ".opcode A {{ .opt [ k ] }} .with ( k : Ints ) -> { .out [ k ]; }",
+		"no bracket":     ".opcode A {{ .opt k }} .with ( k : Ints = 0 ) -> { .out [ k ]; }",
+		"unclosed group": ".opcode A {{ .opt [ k }} .with ( k : Ints = 0 ) -> { .out [ k ]; }",
+		"not a member":   ".set R { X; } .opcode A {{ .opt [ r ] }} .with ( r : R = Y ) -> { .out [ r ]; }",
+		"inline default": ".inline F .with ( k : Ints = 0 ) -> { .return k; }",
+	})
+}
+
+func TestConstantsAndTables(t *testing.T) {
+	lang := loadTestLanguage(t, "consts/consts.casm")
+	if v, found := lang.ConstOf("JP_BASE"); !found || v != 0xC2 {
+		t.Errorf("Expected JP_BASE to be 0xC2, found %X", v)
+	}
+	bin, _, err := assembleTestSource(t, lang, "consts/consts.s")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectBytes(t, bin, []uint8{0x20, 0x10, 0x38, 0x11, 0xCA, 0x12, 0x09, 0x19})
+
+	_, _, err = assembleTestSource(t, lang, "consts/outside.s")
+	if err == nil || !strings.Contains(err.Error(), "Index outside of table SQUARES of 6 values") {
+		t.Errorf("Expected an index outside of SQUARES, found %v", err)
+	}
+
+	expectLanguageErrors(t, map[string]string{
+		"redeclared":     ".const A = 1; .table A { 1 }",
+		"not constant":   ".const A = B;",
+		"known outside":  ".table T { 1, 2 } .opcode X {{ }} .with ( ) -> { .out [ T .get 2 ]; }",
+		"table as value": ".table T { 1, 2 } .opcode X {{ }} .with ( ) -> { .out [ T + 1 ]; }",
+		"not a table":    ".const A = 1; .opcode X {{ }} .with ( ) -> { .out [ A .get 0 ]; }",
+	})
+}
+
+func TestNumbers(t *testing.T) {
+	lang := loadTestLanguage(t, "numbers/numbers.casm")
+	expected := map[string]int64{"MASK": 0xFFFFFFFF, "BIG": 0x100000000, "ALL": -1, "MIN": math.MinInt64}
+	for name, v := range expected {
+		if found, _ := lang.ConstOf(name); found != v {
+			t.Errorf("Expected %s to be %d, found %d", name, v, found)
+		}
+	}
+	bin, _, err := assembleTestSource(t, lang, "numbers/numbers.s")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectBytes(t, bin, []uint8{0x12, 0x01, 0xFF, 0xF5, 0x0F, 0x7F, 0x01, 0x01, 0x11, 0x0F, 0x10, 0x03})
+}
+
+func TestCollectionOperators(t *testing.T) {
+	lang := loadTestLanguage(t, "collections/collections.casm")
+	bin, _, err := assembleTestSource(t, lang, "collections/collections.s")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectBytes(t, bin, []uint8{0x00, 0x01, 0x04, 0x04, 0x01, 0x01, 0x04, 0x04, 0x02, 0x01, 0x03, 0x04, 0x03, 0x01, 0x03, 0x05})
+
+	expectLanguageErrors(t, map[string]string{
+		"builtin set":    ".opcode X {{ # n }} .with ( n : Ints ) -> { .out [ n .in Ints ]; }",
+		"in a value":     ".const A = 1; .opcode X {{ # n }} .with ( n : Ints ) -> { .out [ n .in A ]; }",
+		"get a value":    ".opcode X {{ # n }} .with ( n : Ints ) -> { .out [ n .get 0 ]; }",
+		"len of a value": ".const A = 1; .opcode X {{ }} .with ( ) -> { .out [ .len A ]; }",
+		"set as value":   ".set S { A; } .opcode X {{ }} .with ( ) -> { .out [ S + 1 ]; }",
+		"set outside":    ".set S { A; B; } .opcode X {{ }} .with ( ) -> { .out [ S .get 2 ]; }",
+	})
+}
+
+func TestInlineOrder(t *testing.T) {
+	lang := loadTestLanguage(t, "inlines/order.casm")
+	bin, _, err := assembleTestSource(t, lang, "inlines/order.s")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectBytes(t, bin, []uint8{0x0C, 0x1C, 0xD5, 0x06, 0x12})
+}
+
+func TestIncludeLanguage(t *testing.T) {
+	lang := loadTestLanguage(t, "include/65c02.casm")
+	bin, _, err := assembleTestSource(t, lang, "include/65c02.s")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectBytes(t, bin, []uint8{0xEA, 0x89, 0x12, 0xDA})
+
+	base := loadTestLanguage(t, "include/base/6502.casm")
+	_, _, err = assembleTestSource(t, base, "include/immediate.s")
+	if err == nil || !strings.Contains(err.Error(), "needs a 65C02") {
+		t.Errorf("Expected the 6502 to reject BIT #, found %v", err)
+	}
+
+	before := loadTestLanguage(t, "include/before.casm")
+	bin, _, err = assembleTestSource(t, before, "include/immediate.s")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectBytes(t, bin, []uint8{0x89, 0x12})
+
+	root, _, err := casm.LoadCasm("../../tests/include/siblings.casm")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = casm.MakeLanguage(root, 8)
+	if err == nil || !strings.Contains(err.Error(), "neither file includes the other") {
+		t.Errorf("Expected an error for the same opcode in two sibling includes, found %v", err)
+	}
+
+	_, _, err = casm.LoadCasm("../../tests/include/missing.casm")
+	if err == nil {
+		t.Error("Expected an error for a missing language file")
+	}
+}
+
+// parseTestErrors parse a source file of the tests folder and return the errors found, in the order they are reported
+func parseTestErrors(t *testing.T, lang casm.Language, sourceFile string) ([]error, []*text.Source) {
+	program := MakeAssemblyProgram()
+	symTable := MakeSymbolTable()
+	symTable.noCase = lang.LabelsIgnoreCase()
+	p := sourceParser{lang: lang, program: &program, symTable: &symTable, files: []*text.Source{}, errs: casm.MakeErrorList()}
+	if err := p.parseFile("../../tests/" + sourceFile); err != nil {
+		t.Fatal(err.Error())
+	}
+	p.missingSymbols()
+	p.sortErrors()
+	return p.errs.Errors(), p.files
+}
+
+func TestNoMatchingOpcode(t *testing.T) {
+	errs, _ := parseTestErrors(t, loadTestLanguage(t, "optional/z80.casm"), "optional/nomatch.s")
+	expected := [][]string{
+		{
+			"operands: LD A:Acc , ( IX:Index -1:Ints )",
+			"candidates:",
+			"    LD Acc , ( Index + Ints )",
+			"                     ^",
+			"    LD Acc , ( Index )",
+			"                     ^",
+		},
+		{"did you mean 'RET'?"},
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors, found %v", len(expected), errs)
+	}
+	for i, err := range errs {
+		parseErr, ok := err.(*casm.ParserError)
+		if !ok {
+			t.Fatalf("Expected a parser error, found %v", err)
+		}
+		notes := parseErr.Notes()
+		if strings.Join(notes, "\n") != strings.Join(expected[i], "\n") {
+			t.Errorf("Expected the notes\n%s\nfound\n%s", strings.Join(expected[i], "\n"), strings.Join(notes, "\n"))
+		}
+	}
+	if !strings.Contains(errs[0].Error(), "No form of '%s' accepts these operands") || !strings.Contains(errs[1].Error(), "Unknown opcode '%s'") {
+		t.Errorf("Expected no form of LD and an unknown RETT, found %v", errs)
+	}
+
+	//the operand without a type in .with does not shift the sets of the ones after it
+	errs, _ = parseTestErrors(t, loadTestLanguage(t, "optional/untyped.casm"), "optional/untyped.s")
+	untyped := []string{
+		"operands: MOV A:Regs , X:Regs",
+		"candidates:",
+		"    MOV ? , Regs",
+		"        ^",
+	}
+	if len(errs) != 1 {
+		t.Fatalf("Expected 1 error, found %v", errs)
+	}
+	if notes := errs[0].(*casm.ParserError).Notes(); strings.Join(notes, "\n") != strings.Join(untyped, "\n") {
+		t.Errorf("Expected the notes\n%s\nfound\n%s", strings.Join(untyped, "\n"), strings.Join(notes, "\n"))
+	}
+}
+
+func TestSourceErrors(t *testing.T) {
+	lang := loadTestLanguage(t, "include/65c02.casm")
+	//the operands of a rejected line are not undefined symbols, the undefined ones are reported at their first use
+	expected := []struct {
+		line    uint32
+		column  uint32
+		message string
+	}{
+		{2, 9, "Unknown opcode"}, {3, 9, "No form of"}, {4, 9, "Unknown opcode"},
+		{6, 18, "Undefined symbol"}, {8, 18, "Undefined symbol"}, {9, 9, "Unknown opcode"},
+	}
+	errs, files := parseTestErrors(t, lang, "include/errors.s")
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors, found %d: %v", len(expected), len(errs), errs)
+	}
+	for i, e := range expected {
+		parseErr, ok := errs[i].(*casm.ParserError)
+		if !ok {
+			t.Fatalf("Expected a positioned error, found %v", errs[i])
+		}
+		_, line, column := files[parseErr.FileIndex()].FindPosition(parseErr.At())
+		if line+1 != e.line || column+1 != e.column || !strings.HasPrefix(parseErr.Error(), e.message) {
+			t.Errorf("Expected %s at %d:%d, found %s at %d:%d", e.message, e.line, e.column, parseErr.Error(), line+1, column+1)
+		}
+	}
+
+	_, err := ParseASMFile(lang, "../../tests/include/errors.s")
+	if err == nil || err.Error() != "6 error(s) during compilation" {
+		t.Errorf("Expected every error of the source to be reported, found %v", err)
+	}
+}
+
+func TestCheckFlag(t *testing.T) {
+	//-check fails on the overlaps and passes on a language without them
+	defer func(args []string, flags *flag.FlagSet) {
+		os.Args, flag.CommandLine = args, flags
+	}(os.Args, flag.CommandLine)
+	for file, code := range map[string]int{"check/overlap.casm": 1, "optional/z80.casm": 0} {
+		os.Args = []string{"casmeleon", "-lang=../../tests/" + file, "-check"}
+		flag.CommandLine = flag.NewFlagSet("casmeleon", flag.ContinueOnError)
+		if exit := run(); exit != code {
+			t.Errorf("Expected -check of %s to exit with %d, found %d", file, code, exit)
+		}
+	}
+}
+
+func benchmarkEvscpu(b *testing.B, optimize bool) {
+	defer casm.SetOptimize(true)
+	casm.SetOptimize(optimize)
+	root, _, err := casm.LoadCasm("../../tests/evscpu/evscpu.casm")
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	lang, err := casm.MakeLanguage(root, 8)
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	SetNumberPrefixes(lang.NumberPrefixes())
+
+	//the VM log and the passes printed by AssembleSource would be measured too
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	stdout := os.Stdout
+	os.Stdout = devNull
+	defer func() {
+		os.Stdout = stdout
+		devNull.Close()
+	}()
+	log := vmio.MakeVMLoggerConsole(vmio.ALL)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		//the instances keep the encoding they converged to, every run starts from a new program
+		b.StopTimer()
+		program, asmErr := ParseASMFile(lang, "../../tests/evscpu/test.s")
+		if asmErr != nil {
+			b.Fatal(asmErr.Error())
+		}
+		b.StartTimer()
+		ex := vmex.MakeInterpreter(lang.Executables(), log, vmex.MakeVMFrame())
+		if _, err := asm.AssembleSource(ex, program.list, asm.MakeSourceContext(8)); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+}
+
+func BenchmarkEvscpu(b *testing.B) {
+	benchmarkEvscpu(b, true)
+}
+
+func BenchmarkEvscpuUnoptimized(b *testing.B) {
+	benchmarkEvscpu(b, false)
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -66,105 +67,166 @@ func exportOutput(originalFileName string, ui ui.UI, output []uint8) {
 	writer.Flush()
 }
 
-func ParseIncludedASMFile(lang casm.Language, program *AssemblyProgram, symTable *SymbolTable, sourceFile string) error {
+// ReportLanguageError print the errors of the language files, with the position and the line of every error that has one
+func ReportLanguageError(err error, langFiles []*text.Source) {
+	list, isList := err.(*casm.ErrorList)
+	if !isList {
+		reportOneLanguageError(err, langFiles)
+		return
+	}
+	for _, e := range list.Errors() {
+		reportOneLanguageError(e, langFiles)
+	}
+	if list.Truncated() {
+		fmt.Printf("Too many errors, stopped after %d\n", len(list.Errors()))
+	} else if len(list.Errors()) > 1 {
+		fmt.Printf("%d errors found\n", len(list.Errors()))
+	}
+}
+
+func reportOneLanguageError(err error, langFiles []*text.Source) {
+	switch e := err.(type) {
+	case *casm.SemanticError:
+		e.PrettyPrint(langFiles[e.FileIndex()])
+	case *casm.ParserError:
+		e.PrettyPrint(langFiles[e.FileIndex()])
+	default:
+		fmt.Println("Error " + err.Error())
+	}
+}
+
+// sourceParser reads a source file and the files it includes, collecting the errors of all of them
+type sourceParser struct {
+	lang     casm.Language
+	program  *AssemblyProgram
+	symTable *SymbolTable
+	files    []*text.Source  //read files, in the order of their file index
+	errs     *casm.ErrorList //syntax errors, unknown opcodes and missing symbols
+}
+
+// parseFile parse the lines of a source file: a line with an error is recorded and skipped, so that
+// the following lines are parsed anyway. The error is returned only if the file cannot be read
+func (p *sourceParser) parseFile(sourceFile string) error {
 	var programfile, programErr = os.Open(sourceFile)
 	if programErr != nil {
 		wnd, _ := os.Getwd()
 		return fmt.Errorf("error during opening of file %s from %s", sourceFile, wnd)
 	}
+	defer programfile.Close()
 
-	code := text.BuildSource(sourceFile)
+	code := text.BuildIndexedSource(sourceFile, uint32(len(p.files)))
+	p.files = append(p.files, &code)
 	programCode := bufio.NewReader(programfile)
 
 	stream := MakeRootStream(programCode, &code)
 
 	parser.ConsumeAll(stream, text.EOL)
 
-	for stream.Peek().ID() != text.EOF {
-		if stream.Peek().Value() == ".include" {
+	for stream.Peek().ID() != text.EOF && !p.errs.Truncated() {
+		start := stream.Peek()
+		if start.Value() == ".include" {
 			stream.Next()
 			toInclude, noFile := parser.Require(stream, text.QuotedString)
 			if noFile != nil {
-				return noFile
-			}
-			includedFileName := toInclude.Value()
-			includedErr := ParseIncludedASMFile(lang, program, symTable, filepath.Dir(sourceFile)+"/"+includedFileName[1:len(includedFileName)-1])
-			if includedErr != nil {
-				return includedErr
+				p.errs.Add(casm.WrapMatchError(noFile, "\n", "\n"))
+			} else {
+				includedFileName := toInclude.Value()
+				includedErr := p.parseFile(filepath.Dir(sourceFile) + "/" + includedFileName[1:len(includedFileName)-1])
+				if includedErr != nil {
+					p.errs.Add(includedErr)
+				}
 			}
 			// the directive is a whole line: consume its end and look at the
 			// next one, or a following .include would reach ParseSourceLine
+			skipLine(stream, &code, start)
 			parser.ConsumeAll(stream, text.EOL)
 			continue
 		}
-		parseErr := ParseSourceLine(lang, stream, symTable, program)
+		parseErr := ParseSourceLine(p.lang, stream, p.symTable, p.program)
 		if parseErr != nil {
-			parseErr, ok := parseErr.(*casm.ParserError)
-			if !ok {
-				fmt.Println(parseErr.Error())
-			} else {
-				parseErr.PrettyPrint(&code)
-			}
-			return errors.New("error during compilation")
+			p.errs.Add(parseErr)
+			skipLine(stream, &code, start)
 		}
 		parser.ConsumeAll(stream, text.EOL)
 	}
-	programfile.Close()
 	return nil
 }
 
-func ParseASMFile(lang casm.Language, sourceFile string) (*AssemblyProgram, error) {
-	var programfile, programErr = os.Open(sourceFile)
-	if programErr != nil {
-		wnd, _ := os.Getwd()
-		return nil, fmt.Errorf("error during opening of file %s from %s", sourceFile, wnd)
+// skipLine skip the symbols left on the line of start, the parse of the line may have stopped anywhere in it
+func skipLine(stream parser.Stream, code *text.Source, start text.Symbol) {
+	_, line, _ := code.FindPosition(start)
+	for stream.Peek().ID() != text.EOF {
+		_, at, _ := code.FindPosition(stream.Peek())
+		if at != line {
+			return
+		}
+		stream.Next()
 	}
+}
 
-	code := text.BuildSource(sourceFile)
-	programCode := bufio.NewReader(programfile)
+// missingSymbols add an error for every symbol that is used but never defined, at its first use
+func (p *sourceParser) missingSymbols() {
+	reported := map[string]bool{}
+	for _, miss := range p.symTable.watchList {
+		if reported[miss.Value()] {
+			continue
+		}
+		reported[miss.Value()] = true
+		matchErr := parser.ExpectedAnyOf(miss, "Undefined symbol '%s', was expecting a defined %s", text.Identifier)
+		p.errs.Add(casm.WrapMatchError(matchErr, "\n", "\n"))
+	}
+}
 
-	stream := MakeRootStream(programCode, &code)
+// sortErrors in the order of their position, file by file: the undefined symbols are found after
+// all the lines are read. The errors without a position come first
+func (p *sourceParser) sortErrors() {
+	errs := p.errs.Errors()
+	sort.SliceStable(errs, func(i, j int) bool {
+		a, okA := errs[i].(*casm.ParserError)
+		b, okB := errs[j].(*casm.ParserError)
+		if !okA || !okB {
+			return !okA && okB
+		}
+		if a.FileIndex() != b.FileIndex() {
+			return a.FileIndex() < b.FileIndex()
+		}
+		_, lineA, columnA := p.files[a.FileIndex()].FindPosition(a.At())
+		_, lineB, columnB := p.files[b.FileIndex()].FindPosition(b.At())
+		return lineA < lineB || (lineA == lineB && columnA < columnB)
+	})
+}
 
+// report the errors, each one with its position and its line when it has them
+func (p *sourceParser) report() {
+	for _, e := range p.errs.Errors() {
+		if parseErr, ok := e.(*casm.ParserError); ok {
+			parseErr.PrettyPrint(p.files[parseErr.FileIndex()])
+		} else {
+			fmt.Println(e.Error())
+		}
+	}
+	if p.errs.Truncated() {
+		fmt.Printf("Too many errors, stopped after %d\n", len(p.errs.Errors()))
+	}
+}
+
+func ParseASMFile(lang casm.Language, sourceFile string) (*AssemblyProgram, error) {
 	program := MakeAssemblyProgram()
 	symTable := MakeSymbolTable()
-	parser.ConsumeAll(stream, text.EOL)
+	symTable.noCase = lang.LabelsIgnoreCase()
 
-	for stream.Peek().ID() != text.EOF {
-		if stream.Peek().Value() == ".include" {
-			stream.Next()
-			toInclude, noFile := parser.Require(stream, text.QuotedString)
-			if noFile != nil {
-				return nil, noFile
-			}
-			includedFileName := toInclude.Value()
-			includedErr := ParseIncludedASMFile(lang, &program, &symTable, filepath.Dir(sourceFile)+"/"+includedFileName[1:len(includedFileName)-1])
-			if includedErr != nil {
-				return nil, includedErr
-			}
-			parser.ConsumeAll(stream, text.EOL)
-			continue
-		}
-		parseErr := ParseSourceLine(lang, stream, &symTable, &program)
-		if parseErr != nil {
-			typedErr, ok := parseErr.(*casm.ParserError)
-			if !ok {
-				fmt.Println(parseErr.Error())
-			} else {
-				typedErr.PrettyPrint(&code)
-			}
-			return nil, errors.New("error during compilation")
-		}
-
-		parser.ConsumeAll(stream, text.EOL)
+	p := sourceParser{lang: lang, program: &program, symTable: &symTable, files: []*text.Source{}, errs: casm.MakeErrorList()}
+	openErr := p.parseFile(sourceFile)
+	if openErr != nil {
+		return nil, openErr
 	}
+	p.missingSymbols()
+	p.sortErrors()
 
-	if len(symTable.watchList) > 0 {
-		for _, miss := range symTable.watchList {
-			fmt.Printf("Missing symbol %s\n", miss.Value())
-		}
-		return nil, fmt.Errorf("missing %d symbols", len(symTable.watchList))
+	if len(p.errs.Errors()) > 0 {
+		p.report()
+		return nil, fmt.Errorf("%d error(s) during compilation", len(p.errs.Errors()))
 	}
-	programfile.Close()
 	return &program, nil
 }
 
@@ -186,16 +248,55 @@ func ExportTraces(lang *casm.Language, list []asm.Compilable) {
 	for _, call := range list {
 		instance, ok := call.(*OpcodeInstance)
 		if ok {
-			args := []int64{}
-			for _, a := range instance.parameters {
-				args = append(args, a.Value())
+			args := append(instance.Arguments(), 0xFFFFFFFF)
+			fmt.Fprintln(file, "fn", instance.name, instance.line)
+			for _, target := range instance.InvokeTargets() {
+				fmt.Fprintln(file, "invoke", target, args)
 			}
+		}
+	}
+}
 
-			args = append(args, 0xFFFFFFFF)
-			fmt.Fprintln(file, "fn", instance.name, instance.line)
-			fmt.Fprintln(file, "invoke", instance.invokeTarget, args)
+// ResolveLayout of the language: the .atom and .endian of the file, replaced by the flags set on the command line.
+// A flag that disagrees with the file is reported, the file is probably meant for a different target
+func ResolveLayout(root parser.CSTNode, set map[string]bool, byteSize uint, endian string) (casm.Layout, []string, error) {
+	warnings := []string{}
+	overrides := casm.Layout{ByteSize: 8, BigEndian: true}
+	if set["byteSize"] {
+		if byteSize != 8 && byteSize != 16 && byteSize != 32 {
+			return overrides, warnings, fmt.Errorf("-byteSize must be 8, 16 or 32, found %d", byteSize)
+		}
+		overrides.ByteSize = uint32(byteSize)
+	}
+	if set["endian"] {
+		if !strings.EqualFold(endian, "big") && !strings.EqualFold(endian, "little") {
+			return overrides, warnings, errors.New("-endian must be big or little")
+		}
+		overrides.BigEndian = strings.EqualFold(endian, "big")
+	}
+
+	declared, err := casm.DeclaredLayout(root, overrides)
+	if err != nil {
+		return overrides, warnings, err
+	}
+	layout := declared
+	if set["byteSize"] {
+		if declared.ByteSize != overrides.ByteSize {
+			warnings = append(warnings, fmt.Sprintf("-byteSize=%d overrides the atom of %d bits declared in the language", byteSize, declared.ByteSize))
+		}
+		layout.ByteSize = overrides.ByteSize
+	}
+	if set["endian"] {
+		if declared.BigEndian != overrides.BigEndian {
+			order := "little"
+			if declared.BigEndian {
+				order = "big"
+			}
+			warnings = append(warnings, fmt.Sprintf("-endian=%s overrides the %s endian order declared in the language", strings.ToLower(endian), order))
 		}
+		layout.BigEndian = overrides.BigEndian
 	}
+	return layout, warnings, nil
 }
 
 func main() {
@@ -207,57 +308,87 @@ func run() int {
 	var debugMode bool
 	var exportAssembly string
 	var dumpTrace bool
+	var checkLang bool
 	var byteSize uint
 	var endian string
+	var maxErrors int
+	var optimize bool
 
 	flag.StringVar(&langFileName, "lang", ".", "-lang=langfile")
 	flag.BoolVar(&debugMode, "debug", false, "-debug=true|false")
 	flag.BoolVar(&dumpTrace, "trace", false, "-trace=true|false")
+	flag.BoolVar(&checkLang, "check", false, "-check, analyze the language file and exit")
 	flag.StringVar(&exportAssembly, "export", "none", "-export=bin|hex")
-	flag.UintVar(&byteSize, "byteSize", 8, "-byteSize=8|16|32")
-	flag.StringVar(&endian, "endian", "big", "-endian=big|little")
-	flag.Parse()
+	flag.UintVar(&byteSize, "byteSize", 8, "-byteSize=8|16|32, overrides the .atom of the language")
+	flag.StringVar(&endian, "endian", "big", "-endian=big|little, overrides the .endian of the language")
+	flag.IntVar(&maxErrors, "max-errors", 20, "-max-errors=N, errors of the language files reported before stopping")
+	flag.BoolVar(&optimize, "optimize", true, "-optimize=true|false, fold the known values of the opcode and inline bodies")
+
+	policy, args := ParseWarningFlags(os.Args[1:])
+	flag.CommandLine.Parse(args)
 
 	tUI := ui.NewConsole(false, false)
 	if strings.EqualFold(langFileName, ".") {
 		tUI.ReportError("missing -lang=langfile", true)
 		return 1
 	}
-	langFile, err := os.Open(langFileName)
-	if err != nil {
-		tUI.ReportError("failed open of file "+langFileName+", "+err.Error(), true)
+	casm.SetMaxErrors(maxErrors)
+	casm.SetOptimize(optimize)
+	root, langFiles, err := casm.LoadCasm(langFileName)
+	if err != nil && len(langFiles) == 0 {
+		tUI.ReportError("failed load of file "+langFileName+", "+err.Error(), true)
 		return 1
 	}
-	source := bufio.NewReader(langFile)
-	repo := text.BuildSource(langFileName)
-
-	stream := casm.BuildStream(source, &repo)
-
-	root, err := casm.ParseCasm(stream, repo)
 
+	//the declarations without syntax errors are analyzed anyway, all the errors are reported together
+	langErrs := casm.MakeErrorList()
 	if err != nil {
-		parseErr, ok := err.(*casm.ParserError)
-		if !ok {
-			fmt.Println("Unexpected Error")
-		} else {
-			parseErr.PrettyPrint(&repo)
-		}
-		return 1
+		langErrs.Add(err)
 	}
 
-	if !strings.EqualFold(endian, "big") && !strings.EqualFold(endian, "little") {
-		tUI.ReportError("-endian must be big or little", true)
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	layout, overrides, layoutErr := ResolveLayout(root, set, byteSize, endian)
+	if layoutErr != nil {
+		langErrs.Add(layoutErr)
+		ReportLanguageError(langErrs, langFiles)
+		return 1
 	}
-	lang, semErr := casm.MakeLanguageEndian(root, uint32(byteSize), strings.EqualFold(endian, "big"))
+	for _, w := range overrides {
+		fmt.Println("Warning: " + w)
+	}
+	lang, semErr := casm.MakeLanguageLayout(root, layout)
 	if semErr != nil {
-		fmt.Println("Error " + semErr.Error())
+		langErrs.Add(semErr)
+	}
+	if len(langErrs.Errors()) > 0 {
+		ReportLanguageError(langErrs, langFiles)
 		return 1
 	}
 
+	if checkLang {
+		found := append(casm.AnalyzeOpcodes(&lang), lang.Diagnostics()...)
+		for _, d := range found {
+			d.PrettyPrint(langFiles[d.FileIndex()])
+		}
+		fmt.Printf("%s: %d problem(s) found\n", langFileName, len(found))
+		if len(found) > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	//the mistakes of the bodies found at load time do not stop the assembly
+	for _, d := range lang.Diagnostics() {
+		fmt.Print("Warning: ")
+		d.PrettyPrint(langFiles[d.FileIndex()])
+	}
+
 	SetNumberPrefixes(lang.NumberPrefixes())
 	RelaxNumberPrefixDelimiters(lang.NumberPrefixes())
 
-	langFile.Close()
 	if tUI.GetErrorCount() > 0 {
 		return 1
 	}
@@ -289,11 +420,28 @@ func run() int {
 
 			log := vmio.MakeVMLoggerConsole(vmio.ALL)
 			ex := vmex.MakeInterpreter(lang.Executables(), log, vmex.MakeVMFrame())
-			ctx := asm.MakeSourceContext(uint32(byteSize))
+			ctx := asm.MakeSourceContext(lang.ByteSize())
 			binaryImage, compilingErr := asm.AssembleSource(ex, program.list, ctx)
 
 			if compilingErr != nil {
-				fmt.Println(compilingErr.Error())
+				if traced, ok := compilingErr.(*AssemblyError); ok {
+					traced.PrettyPrint()
+				} else {
+					fmt.Println(compilingErr.Error())
+				}
+				status = 1
+				break
+			}
+
+			warnings := CollectWarnings(program.list, policy)
+			for _, w := range warnings {
+				w.PrettyPrint()
+			}
+			if len(warnings) > 0 {
+				fmt.Printf("%s: %d warning(s)\n", f, len(warnings))
+			}
+			if policy.asErrors && len(warnings) > 0 {
+				fmt.Println("Error: warnings are treated as errors (-Werror)")
 				status = 1
 				break
 			}
@@ -5,61 +5,172 @@ import (
 
 	"github.com/aleferri/casmeleon/internal/casm"
 	"github.com/aleferri/casmeleon/pkg/asm"
+	"github.com/aleferri/casmeleon/pkg/text"
 	"github.com/aleferri/casmvm/pkg/opcodes"
 	"github.com/aleferri/casmvm/pkg/vmex"
 )
 
 type OpcodeInstance struct {
 	name          string
+	candidates    []casm.Opcode
 	parameters    []asm.Symbol
 	symTable      *SymbolTable
 	atom          uint32
 	bigEndian     bool
-	invokeTarget  int32
+	chosen        int
+	floor         uint32
 	line          uint32
 	addrInvariant bool
+	mnemonic      text.Symbol   //opcode name in the source
+	operands      []text.Symbol //source token of every parameter
+	members       []bool        //operands that are set members, valued by the set of the candidate
+	source        *text.Source
+	warnings      []*AssemblyError //warnings raised by the chosen candidate in the last run
 }
 
-func MakeOpcodeInstance(opcode casm.Opcode, format ArgumentFormat, symTable *SymbolTable, atom uint32, bigEndian bool) *OpcodeInstance {
+func MakeOpcodeInstance(candidates []casm.Opcode, format ArgumentFormat, symTable *SymbolTable, atom uint32, bigEndian bool) *OpcodeInstance {
 	if atom == 0 {
 		atom = 1
 	}
-	//an opcode that reads .addr is exactly the one that is NOT invariant to it
+	//an opcode that reads .addr is exactly the one that is NOT invariant to it,
+	//and the choice between candidates is invariant only if all of them are
+	invariant := true
+	for _, op := range candidates {
+		invariant = invariant && !op.UseAddress()
+	}
 	inst := OpcodeInstance{
-		addrInvariant: !opcode.UseAddress(), name: opcode.Name(), parameters: format.parameters,
-		symTable: symTable, atom: atom, bigEndian: bigEndian, invokeTarget: opcode.InvokeTarget(),
+		addrInvariant: invariant, name: candidates[0].Name(), candidates: candidates, parameters: format.parameters,
+		symTable: symTable, atom: atom, bigEndian: bigEndian, operands: format.symbols, members: format.members,
 	}
 	return &inst
 }
 
-func (c *OpcodeInstance) Assemble(m opcodes.VM, addr uint32, index int, ctx asm.Context) (uint32, []uint8, error) {
-	k := uint16(0)
+//LocateIn record where the instance was found, errors raised by its body are reported there
+func (c *OpcodeInstance) LocateIn(source *text.Source, mnemonic text.Symbol) {
+	c.source = source
+	c.mnemonic = mnemonic
+	_, line, _ := source.FindPosition(mnemonic)
+	c.line = line + 1
+}
+
+//traceError maps an error raised by the body of a candidate back to the operand that caused it.
+//An .error of an inline is reported at the mnemonic, with the value it reported
+func (c *OpcodeInstance) traceError(op casm.Opcode, err error, ctx asm.Context) error {
+	if c.source == nil {
+		return err
+	}
+	traced := &AssemblyError{message: err.Error(), source: c.source, at: c.mnemonic, pass: ctx.Pass(), opcode: op.Name()}
+	signal, value, found := casm.FindSignal(op.Signals(), err.Error(), true)
+	if !found {
+		return traced
+	}
+	traced.message = signal.Message()
+	traced.origin = signal.Origin()
+	traced.value, traced.hasValue = value, true
+	//a parameter that takes its default has no operand to point at
+	operand := op.Operand(signal.Param())
+	if operand >= 0 && operand < len(c.parameters) {
+		traced.at = c.operands[operand]
+		traced.value = c.valueOf(op, operand)
+		traced.hasValue = true
+	}
+	return traced
+}
+
+//valueOf the operand for the candidate op: a register takes the value of the set that accepted it in op
+func (c *OpcodeInstance) valueOf(op casm.Opcode, operand int) int64 {
+	if c.members[operand] {
+		if v, found := op.MemberValue(operand, c.operands[operand].Value()); found {
+			return v
+		}
+	}
+	return c.parameters[operand].Value()
+}
+
+// Arguments of the instance as passed to the chosen candidate
+func (c *OpcodeInstance) Arguments() []int64 {
+	args := []int64{}
+	for i := range c.parameters {
+		args = append(args, c.valueOf(c.candidates[c.chosen], i))
+	}
+	return args
+}
+
+// InvokeTargets of every candidate, in declaration order
+func (c *OpcodeInstance) InvokeTargets() []int32 {
+	targets := []int32{}
+	for _, op := range c.candidates {
+		targets = append(targets, op.InvokeTarget())
+	}
+	return targets
+}
+
+//warningAt build the warning reported by slot with value v
+func (c *OpcodeInstance) warningAt(op casm.Opcode, slot casm.Slot, v int64, ctx asm.Context) *AssemblyError {
+	raised := &AssemblyError{
+		message: slot.Signal().Message(), source: c.source, at: c.mnemonic, pass: ctx.Pass(),
+		value: v, hasValue: true, warning: true, opcode: op.Name(), origin: slot.Origin(),
+	}
+	operand := op.Operand(slot.Signal().Param())
+	if operand >= 0 && operand < len(c.operands) {
+		raised.at = c.operands[operand]
+	}
+	return raised
+}
 
+// Warnings raised by the last assembly of the instance
+func (c *OpcodeInstance) Warnings() []*AssemblyError {
+	return c.warnings
+}
+
+func (c *OpcodeInstance) run(m opcodes.VM, op casm.Opcode, addr uint32, ctx asm.Context) ([]uint8, []*AssemblyError, error) {
 	frame := vmex.MakeVMFrame()
 
-	for _, a := range c.parameters {
-		frame.Values().Put(k, a.Value())
-		k++
-		if a.IsDynamic() {
-			//Mark dynamic symbols only
-			ctx.GuardSymbol(a.Name(), index, addr, c)
+	//the parameters of the optional groups that are not in the source line take their default
+	k := uint16(0)
+	for ; int(k) < op.ParamCount(); k++ {
+		v := op.Default(int(k))
+		if operand := op.Operand(int(k)); operand >= 0 {
+			v = c.valueOf(op, operand)
 		}
+		frame.Values().Put(k, v)
 	}
 
 	frame.Values().Put(k, int64(addr/(ctx.ByteSize()/8)))
 
-	err := m.Start(c.invokeTarget, &frame)
+	err := m.Start(op.InvokeTarget(), &frame)
 
 	if err != nil {
-		return addr, nil, err
+		return nil, nil, err
 	}
 
 	outs := frame.Returns()
 	bin := []uint8{}
-	size := uint16(outs.Size())
+
+	//the slots follow the outputs as a flag and a value each: the values of
+	//the .emit that were executed come first in the output, in order
+	slots := op.Slots()
+	size := uint16(outs.Size()) - uint16(2*len(slots))
+	raised := []*AssemblyError{}
+	values := []int64{}
+	for k, slot := range slots {
+		at := size + uint16(2*k)
+		if outs.Peek(at) == 0 {
+			continue
+		}
+		if slot.IsEmit() {
+			values = append(values, outs.Peek(at+1))
+		} else if c.source != nil {
+			raised = append(raised, c.warningAt(op, slot, outs.Peek(at+1), ctx))
+		}
+	}
 	for i := uint16(0); i < size; i++ {
+		values = append(values, outs.Peek(i))
+	}
+
+	for _, value := range values {
 		//Every value returned by .out is one atom, spread over atom bytes
-		v := uint64(outs.Peek(i))
+		v := uint64(value)
 		if c.bigEndian {
 			for b := c.atom; b > 0; b-- {
 				bin = append(bin, uint8(v>>(8*(b-1))))
@@ -70,7 +181,74 @@ func (c *OpcodeInstance) Assemble(m opcodes.VM, addr uint32, index int, ctx asm.
 			}
 		}
 	}
-	return addr + uint32(size)*c.atom, bin, nil
+	return bin, raised, nil
+}
+
+//Assemble runs every candidate whose pattern matched the source line and keeps
+//the smallest encoding among those that did not raise an .error. Ties go to the
+//candidate declared first.
+//
+//The choice is monotone: once the instance has grown it never picks a shorter
+//encoding again, even if the labels it depends on would now allow it. Letting
+//it shrink is what makes a fixed point oscillate, because the shrink moves the
+//labels back to where they were when the longer form was required. When every
+//form that succeeds is shorter than the size already committed to, the line
+//is an error: no encoding keeps the addresses of the previous pass.
+func (c *OpcodeInstance) Assemble(m opcodes.VM, addr uint32, index int, ctx asm.Context) (uint32, []uint8, error) {
+	for _, a := range c.parameters {
+		if a.IsDynamic() {
+			//Mark dynamic symbols only
+			ctx.GuardSymbol(a.Name(), index, addr, c)
+		}
+	}
+
+	var firstErr error
+	var firstErrOp casm.Opcode
+	var best []uint8
+	var bestWarnings []*AssemblyError
+	chosen := -1
+	longest := -1
+
+	for i, op := range c.candidates {
+		bin, raised, err := c.run(m, op, addr, ctx)
+		if err != nil {
+			if firstErr == nil {
+				firstErr, firstErrOp = err, op
+			}
+			continue
+		}
+		size := uint32(len(bin))
+		if size >= c.floor && (chosen < 0 || size < uint32(len(best))) {
+			best, chosen, bestWarnings = bin, i, raised
+		}
+		if len(bin) > longest {
+			longest = len(bin)
+		}
+	}
+
+	if chosen < 0 {
+		if longest < 0 {
+			return addr, nil, c.traceError(firstErrOp, firstErr, ctx)
+		}
+		return addr, nil, c.shrinkError(uint32(longest), ctx)
+	}
+
+	c.chosen = chosen
+	c.warnings = bestWarnings
+	if uint32(len(best)) > c.floor {
+		c.floor = uint32(len(best))
+	}
+	return addr + uint32(len(best)), best, nil
+}
+
+//shrinkError is raised when the forms that succeed are all shorter than the size of an earlier pass
+func (c *OpcodeInstance) shrinkError(longest uint32, ctx asm.Context) error {
+	message := fmt.Sprintf("No form of %s keeps the %d byte(s) of the previous pass, the longest that succeeds takes %d: the addresses cannot converge",
+		c.name, c.floor, longest)
+	if c.source == nil {
+		return fmt.Errorf("%s", message)
+	}
+	return &AssemblyError{message: message, source: c.source, at: c.mnemonic, pass: ctx.Pass()}
 }
 
 func (c *OpcodeInstance) IsAddressInvariant() bool {
@@ -20,15 +20,25 @@ func (p *SelfPatchSymbol) Address() uint32 {
 	return 0
 }
 
-func (p *SelfPatchSymbol) Value() int64 {
+// resolve the symbol referenced, true once it is declared
+func (p *SelfPatchSymbol) resolve() bool {
 	if !p.patched {
-		p.sym, _ = p.symTable.Search(p.fqn)
-		p.patched = true
+		p.sym, p.patched = p.symTable.Search(p.fqn)
 	}
+	return p.patched
+}
+
+func (p *SelfPatchSymbol) Value() int64 {
+	p.resolve()
 	return p.sym.Value()
 }
 
+// Name of the symbol as it was declared: a reference in a case insensitive source
+// must be guarded under the same name that the label refreshes
 func (p *SelfPatchSymbol) Name() string {
+	if p.resolve() {
+		return p.sym.Name()
+	}
 	return p.fqn
 }
 
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"strings"
+
 	"github.com/aleferri/casmeleon/pkg/asm"
 	"github.com/aleferri/casmeleon/pkg/text"
 )
@@ -9,6 +11,12 @@ type SymbolTable struct {
 	list            []asm.Symbol
 	lastGlobalLabel *asm.Label
 	watchList       []text.Symbol
+	noCase          bool //labels match ignoring the case
+}
+
+// sameName of two labels, ignoring the case if the table is case insensitive
+func (t *SymbolTable) sameName(a string, b string) bool {
+	return a == b || (t.noCase && strings.EqualFold(a, b))
 }
 
 func (t *SymbolTable) Add(sym asm.Symbol) {
@@ -17,7 +25,7 @@ func (t *SymbolTable) Add(sym asm.Symbol) {
 
 func (t *SymbolTable) Search(name string) (asm.Symbol, bool) {
 	for _, s := range t.list {
-		if s.Name() == name {
+		if t.sameName(s.Name(), name) {
 			return s, true
 		}
 	}
@@ -31,13 +39,20 @@ func (t *SymbolTable) Watch(token text.Symbol) {
 func (t *SymbolTable) UnWatch(name string) {
 	rerun := []text.Symbol{}
 	for _, w := range t.watchList {
-		if w.Value() != name {
+		if !t.sameName(w.Value(), name) {
 			rerun = append(rerun, w)
 		}
 	}
 	t.watchList = rerun
 }
 
+// UnWatchFrom forget the symbols watched since the watch list had mark symbols, the ones of a rejected line
+func (t *SymbolTable) UnWatchFrom(mark int) {
+	if mark < len(t.watchList) {
+		t.watchList = t.watchList[:mark]
+	}
+}
+
 func MakeSymbolTable() SymbolTable {
 	return SymbolTable{list: []asm.Symbol{}, lastGlobalLabel: nil, watchList: []text.Symbol{}}
 }
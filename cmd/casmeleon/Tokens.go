@@ -97,7 +97,8 @@ var idDescriptor = []string{
 	"@", "#", "->", "/*", "*/", "//", "Quoted String", "Quoted Char", "+", "-", "*", "/", "%", ">>", "<<", "&", "&&",
 	"|", "||", "^", "!", "~", "<", "==", "<=", ">=", ">", "!=", ".if Keyword", ".else Keyword", ".out Keyword", ".outr Keyword", ".set Keyword",
 	".num Keyword", ".atom Keyword", ".inline Keyword", ".opcode Keyword", ".with Keyword", ".expr Keyword", ".warning Keyword", ".error Keyword",
-	".return Keyword", "Number", "Identifier", "Out of bounds",
+	".return Keyword", ".let Keyword", "=", ".for Keyword", ".while Keyword", ".limit Keyword",
+	".emit Keyword", ".bits Keyword", ".endian Keyword", ".byte Keyword", ".case Keyword", ".opt Keyword", ".const Keyword", ".table Keyword", ".include Keyword", "Number", "Identifier", "Out of bounds",
 }
 
 var temporaryTokenMarks = map[int32]int32{1: 1, 2: 2, 3: 3, 4: 5}
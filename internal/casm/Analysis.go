@@ -0,0 +1,107 @@
+package casm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aleferri/casmeleon/pkg/text"
+)
+
+// Kinds of Diagnostic
+const (
+	AMBIGUOUS     = 0
+	UNREACHABLE   = 1
+	UNUSED_PARAM  = 2 //parameter of .with that is not in the pattern
+	UNTYPED_PARAM = 3 //identifier of the pattern without a type in .with
+	DEAD_CODE     = 4 //statement after an .out, .outr, .return or .error
+	NO_OUTPUT     = 5 //path of a body that ends without output or error
+)
+
+// Diagnostic is a problem of the language definition found by the analysis, located in the .casm file
+type Diagnostic struct {
+	kind    uint32
+	message string
+	at      text.Symbol
+	other   text.Symbol
+}
+
+// Kind of the diagnostic
+func (d Diagnostic) Kind() uint32 {
+	return d.kind
+}
+
+func (d Diagnostic) Error() string {
+	return d.message
+}
+
+// FileIndex of the language file of the declarations involved
+func (d Diagnostic) FileIndex() uint32 {
+	return d.at.FileIndex()
+}
+
+// At is the symbol of the language file where the problem is
+func (d Diagnostic) At() text.Symbol {
+	return d.at
+}
+
+// PrettyPrint the diagnostic with its position, and the position of the other declaration involved if any
+func (d Diagnostic) PrettyPrint(source *text.Source) {
+	fileName, line, column := source.FindPosition(d.at)
+	if d.other.ID() == text.NONE {
+		fmt.Printf("%s:%d:%d: %s\n", fileName, line+1, column+1, d.message)
+	} else {
+		_, otherLine, otherColumn := source.FindPosition(d.other)
+		fmt.Printf("%s:%d:%d: %s, see the declaration at %d:%d\n", fileName, line+1, column+1, d.message, otherLine+1, otherColumn+1)
+	}
+	source.PrintContext(text.MakeMessageContext(d.at, "\n", "\n"))
+}
+
+func sameListing(a Opcode, b Opcode) bool {
+	if len(a.runList) != len(b.runList) {
+		return false
+	}
+	for i, op := range a.runList {
+		if op.String() != b.runList[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+// AnalyzeOpcodes compares the patterns of the opcodes with the same name, with every form of their optional
+// groups. Two opcodes whose patterns accept the same source lines, because they are equal or because their
+// sets share members, are both candidates for those lines: the shortest encoding wins and the declaration
+// order breaks the ties, so the later one is unreachable if it accepts only lines of the earlier one and its
+// body is a copy, and ambiguous otherwise.
+func AnalyzeOpcodes(lang *Language) []Diagnostic {
+	found := []Diagnostic{}
+	for i, op := range lang.opcodes {
+		for _, prev := range lang.opcodes[:i] {
+			if prev.frame == op.frame {
+				//forms of the same declaration
+				continue
+			}
+			partial, overlaps := op.Overlap(prev)
+			if !overlaps {
+				continue
+			}
+			pattern := strings.TrimSpace(op.name + " " + strings.Join(op.StringifyFormat(lang), " "))
+			switch {
+			case len(partial) == 0 && sameListing(op, prev):
+				msg := "unreachable pattern '" + pattern + "': every line it accepts matches a previous opcode with the same body"
+				found = append(found, Diagnostic{UNREACHABLE, msg, op.symbol, prev.symbol})
+			case op.SamePattern(prev):
+				msg := "ambiguous pattern '" + pattern + "': same pattern of a previous opcode, the shortest encoding is chosen"
+				found = append(found, Diagnostic{AMBIGUOUS, msg, op.symbol, prev.symbol})
+			case len(partial) == 0:
+				msg := "ambiguous pattern '" + pattern + "': every line it accepts matches also a previous opcode, the shortest encoding is chosen"
+				found = append(found, Diagnostic{AMBIGUOUS, msg, op.symbol, prev.symbol})
+			default:
+				msg := "ambiguous pattern '" + pattern + "': the lines with " + strings.Join(partial, " and ") + " match also a previous opcode, the shortest encoding is chosen"
+				found = append(found, Diagnostic{AMBIGUOUS, msg, op.symbol, prev.symbol})
+			}
+			break
+		}
+	}
+	return found
+}
@@ -0,0 +1,72 @@
+package casm
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aleferri/casmeleon/pkg/text"
+)
+
+func TestAnalyzeOpcodes(t *testing.T) {
+	fileName := "../../tests/check/ambiguous.casm"
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer file.Close()
+	repo := text.BuildSource(fileName)
+	root, err := ParseCasm(BuildStream(bufio.NewReader(file), &repo), repo)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	lang, err := MakeLanguage(root, 8)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := []struct {
+		kind  uint32
+		line  uint32
+		other uint32
+	}{
+		{UNREACHABLE, 14, 8}, {AMBIGUOUS, 20, 8},
+	}
+	found := AnalyzeOpcodes(&lang)
+	if len(found) != len(expected) {
+		t.Fatalf("Expected %d diagnostics, found %v", len(expected), found)
+	}
+	for i, e := range expected {
+		_, line, _ := repo.FindPosition(found[i].at)
+		_, other, _ := repo.FindPosition(found[i].other)
+		if found[i].Kind() != e.kind || line+1 != e.line || other+1 != e.other {
+			t.Errorf("Expected kind %d at line %d against line %d, found kind %d at line %d against line %d",
+				e.kind, e.line, e.other, found[i].Kind(), line+1, other+1)
+		}
+	}
+}
+
+func TestPatternOverlap(t *testing.T) {
+	expected := []struct {
+		kind    uint32
+		line    uint32
+		message string
+	}{
+		{UNREACHABLE, 25, "unreachable pattern 'INC Low'"},
+		{AMBIGUOUS, 31, "the lines with c in C match also a previous opcode"},
+		{AMBIGUOUS, 42, "ambiguous pattern 'RET': same pattern"},
+		{AMBIGUOUS, 53, "ambiguous pattern 'DEC Regs': same pattern"},
+	}
+	lang, files := loadTestLanguage(t, "check/overlap.casm")
+	found := AnalyzeOpcodes(&lang)
+	if len(found) != len(expected) {
+		t.Fatalf("Expected %d diagnostics, found %v", len(expected), found)
+	}
+	for i, d := range found {
+		_, line, _ := files[d.FileIndex()].FindPosition(d.At())
+		if d.Kind() != expected[i].kind || line+1 != expected[i].line || !strings.Contains(d.Error(), expected[i].message) {
+			t.Errorf("Expected '%s' of kind %d at line %d, found '%s' of kind %d at line %d", expected[i].message, expected[i].kind, expected[i].line, d.Error(), d.Kind(), line+1)
+		}
+	}
+}
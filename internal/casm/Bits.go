@@ -0,0 +1,141 @@
+package casm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aleferri/casmeleon/pkg/parser"
+	"github.com/aleferri/casmvm/pkg/opcodes"
+	"github.com/aleferri/casmvm/pkg/operators"
+)
+
+// maxWordBits is the widest word that .bits can pack, values are int64
+const maxWordBits = 64
+
+// bitField of a .bits statement
+type bitField struct {
+	node  parser.CSTNode //expression of the value
+	width int64
+	shift int64 //position of the least significant bit of the field in the word
+}
+
+// CompileBits compile the packing of fields into a word, emitted as width / byteSize values in the language
+// byte order. The widths are checked at compile time; at run time a value that does not fit its field is
+// an error. A value fits if it is a valid unsigned or a valid two's complement number of the field width.
+func CompileBits(lang *Language, fn *ListingContext, node parser.CSTNode, listing *[]opcodes.Opcode) (bool, error) {
+	syms := node.Symbols()
+	word, err := strconv.ParseInt(syms[1].Value(), 10, 64)
+	if err != nil {
+		return false, semanticError(syms[1], "Invalid word width "+syms[1].Value())
+	}
+	if word <= 0 || word > maxWordBits || word%int64(lang.byteSize) != 0 {
+		return false, semanticErrorf(syms[1], "The word width must be a multiple of %d up to %d bits, found %d", lang.byteSize, maxWordBits, word)
+	}
+	lsbFirst := len(syms) > 2 && syms[2].Value() == "lsb"
+
+	fields := []bitField{}
+	used := int64(0)
+	for _, f := range node.Children() {
+		width, widthErr := strconv.ParseInt(f.Symbols()[0].Value(), 10, 64)
+		if widthErr != nil || width <= 0 {
+			return false, semanticError(f.Symbols()[0], "Invalid field width "+f.Symbols()[0].Value())
+		}
+		fields = append(fields, bitField{node: f.Children()[0], width: width, shift: used})
+		used += width
+	}
+	if used != word {
+		return false, semanticErrorf(syms[1], "The fields are %d bits wide, but the word is %d bits", used, word)
+	}
+	if !lsbFirst {
+		for i := range fields {
+			fields[i].shift = word - fields[i].shift - fields[i].width
+		}
+	}
+
+	useAddr := false
+	packed := fn.constant(listing, 0)
+	for _, f := range fields {
+		value, fieldUseAddr, fieldErr := compileExpressionNode(lang, fn, f.node, listing)
+		if fieldErr != nil {
+			return false, errorAt(fieldErr, firstSymbol(f.node))
+		}
+		useAddr = useAddr || fieldUseAddr
+
+		//-2^(width-1) <= value < 2^width, the check is skipped if any int64 fits
+		if f.width < 63 {
+			low := fn.constant(listing, -(int64(1) << (f.width - 1)))
+			high := fn.constant(listing, int64(1)<<f.width)
+			fits := fn.binary(listing, "&&", fn.binary(listing, ">=", value, low), fn.binary(listing, "<", value, high))
+			overflow := fn.nextLocal
+			fn.nextLocal++
+			*listing = append(*listing, opcodes.MakeUnaryOp(overflow, "not", opcodes.IntShape, fits, operators.UnaryOperatorsSymbols["!"]))
+
+			source := f.node.Symbols()
+			text := make([]string, len(source))
+			for i, s := range source {
+				text[i] = s.Value()
+			}
+			msg := fmt.Sprintf("%s does not fit in a field of %d bits", strings.Join(text, " "), f.width)
+			signal := fn.addSignal(lang, msg, source[0], true)
+			*listing = append(*listing, opcodes.MakeBranch(0, overflow, 1), opcodes.MakeSigError(signal.vmText(), value))
+		}
+
+		mask := fn.constant(listing, int64(uint64(1)<<uint64(f.width)-1))
+		field := fn.binary(listing, "&", value, mask)
+		if f.shift > 0 {
+			field = fn.binary(listing, "<<", field, fn.constant(listing, f.shift))
+		}
+		packed = fn.binary(listing, "|", packed, field)
+	}
+
+	//the word is split into values of the language byte size
+	for _, part := range splitValue(lang, fn, listing, packed, word, lang.bigEndian) {
+		fn.emit(listing, part)
+	}
+	return useAddr, nil
+}
+
+// CompileOutItem compile a value of .out or .emit. A value with an explicit width is split into width / atom
+// values, in the declared byte order or in the one of the language; a value without width is a single atom.
+func CompileOutItem(lang *Language, fn *ListingContext, item parser.CSTNode, listing *[]opcodes.Opcode) ([]uint16, bool, error) {
+	if item.ID() != OUT_ITEM {
+		local, useAddr, err := compileExpressionNode(lang, fn, item, listing)
+		return []uint16{local}, useAddr, err
+	}
+
+	syms := item.Symbols()
+	width, err := strconv.ParseInt(syms[0].Value(), 10, 64)
+	if err != nil || width <= 0 || width > maxWordBits || width%int64(lang.byteSize) != 0 {
+		return nil, false, semanticErrorf(syms[0], "The width of a value must be a multiple of %d up to %d bits, found %s", lang.byteSize, maxWordBits, syms[0].Value())
+	}
+	bigEndian := lang.bigEndian
+	if len(syms) > 1 {
+		bigEndian = syms[1].Value() == "be"
+	}
+
+	local, useAddr, err := compileExpressionNode(lang, fn, item.Children()[0], listing)
+	if err != nil {
+		return nil, false, err
+	}
+	return splitValue(lang, fn, listing, local, width, bigEndian), useAddr, nil
+}
+
+// splitValue of width bits into atoms, the most significant first if bigEndian
+func splitValue(lang *Language, fn *ListingContext, listing *[]opcodes.Opcode, local uint16, width int64, bigEndian bool) []uint16 {
+	count := width / int64(lang.byteSize)
+	if count == 1 {
+		return []uint16{local}
+	}
+	mask := fn.constant(listing, int64(uint64(1)<<uint64(lang.byteSize)-1))
+	parts := []uint16{}
+	for k := int64(0); k < count; k++ {
+		index := k
+		if bigEndian {
+			index = count - 1 - k
+		}
+		part := fn.binary(listing, ">>", local, fn.constant(listing, index*int64(lang.byteSize)))
+		parts = append(parts, fn.binary(listing, "&", part, mask))
+	}
+	return parts
+}
@@ -4,11 +4,35 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/aleferri/casmeleon/pkg/text"
 )
 
+// buildTestLanguage from the source of a language file
+func buildTestLanguage(t *testing.T, name string, src string) (Language, error) {
+	repo := text.BuildSource(name)
+	root, err := ParseCasm(BuildStream(bufio.NewReader(strings.NewReader(src)), &repo), repo)
+	if err != nil {
+		t.Fatalf("Unexpected syntax error in %s: %s", name, err.Error())
+	}
+	return MakeLanguage(root, 8)
+}
+
+// loadTestLanguage from a language file of the tests folder, with the files it includes
+func loadTestLanguage(t *testing.T, langFile string) (Language, []*text.Source) {
+	root, files, err := LoadCasm("../../tests/" + langFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	lang, err := MakeLanguage(root, 8)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return lang, files
+}
+
 func TestCasmProcessing(t *testing.T) {
 	fileName := "../../tests/parser_test.casm"
 	var file, fileErr = os.Open(fileName)
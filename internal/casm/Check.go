@@ -0,0 +1,201 @@
+package casm
+
+import (
+	"fmt"
+
+	"github.com/aleferri/casmeleon/pkg/parser"
+	"github.com/aleferri/casmeleon/pkg/text"
+)
+
+// flowPath is a way through a body: ended if it reached an .out, .outr, .return or .error, output if it
+// reached an output or an error, silentAt is the branch where it took the side without output
+type flowPath struct {
+	ended    bool
+	output   bool
+	silentAt text.Symbol
+}
+
+// checker of the opcode and inline bodies of a language file
+type checker struct {
+	found []Diagnostic
+}
+
+// CheckLanguage find the mistakes of the opcodes and the inlines that would be found only by a source line
+// that hits them: parameters of .with that are not in the pattern, identifiers of the pattern without a type,
+// statements that are never executed and paths of a body without output. The calls of the inlines are checked
+// when they are compiled. The mistakes do not stop the assembly, they are reported as diagnostics
+func CheckLanguage(root parser.CSTNode) []Diagnostic {
+	c := checker{found: []Diagnostic{}}
+	for _, k := range root.Children() {
+		switch k.ID() {
+		case OPCODE_NODE:
+			name := k.Symbols()[1]
+			c.checkPattern(name, k.Children()[0], k.Children()[1])
+			c.checkBody(name, "opcode", k.Children()[2])
+		case INLINE_NODE:
+			c.checkBody(k.Symbols()[1], "inline", k.Children()[1])
+		}
+	}
+	return c.found
+}
+
+func (c *checker) report(kind uint32, at text.Symbol, format string, args ...interface{}) {
+	c.found = append(c.found, Diagnostic{kind: kind, message: fmt.Sprintf(format, args...), at: at})
+}
+
+// checkPattern compare the identifiers of the pattern with the parameters of .with
+func (c *checker) checkPattern(name text.Symbol, format parser.CSTNode, with parser.CSTNode) {
+	pattern := []text.Symbol{}
+	if len(format.Children()) > 0 {
+		pattern = format.Children()[0].Symbols()
+	}
+
+	typed := map[string]bool{}
+	for _, arg := range with.Children() {
+		typed[arg.Symbols()[0].Value()] = true
+	}
+	inPattern := map[string]bool{}
+	for _, f := range pattern {
+		if f.ID() != text.Identifier {
+			continue
+		}
+		if !typed[f.Value()] && !inPattern[f.Value()] {
+			c.report(UNTYPED_PARAM, f, "%s in the pattern of opcode %s has no type in .with, the pattern never matches", f.Value(), name.Value())
+		}
+		inPattern[f.Value()] = true
+	}
+	for _, arg := range with.Children() {
+		param := arg.Symbols()[0]
+		if !inPattern[param.Value()] {
+			c.report(UNUSED_PARAM, param, "parameter %s of opcode %s is not in the pattern, it cannot be used in the body", param.Value(), name.Value())
+		}
+	}
+}
+
+// checkBody follow the paths of the body
+func (c *checker) checkBody(name text.Symbol, what string, body parser.CSTNode) {
+	paths := c.flow(name, body, []flowPath{{}})
+	silent := map[text.Symbol]bool{}
+	for _, p := range paths {
+		if p.ended || p.output || silent[p.silentAt] {
+			continue
+		}
+		silent[p.silentAt] = true
+		at := p.silentAt
+		if at.ID() == text.NONE {
+			at = name
+		}
+		if what == "opcode" {
+			c.report(NO_OUTPUT, at, "a path of opcode %s ends without .out, .outr, .emit, .bits or .error", name.Value())
+		} else {
+			c.report(NO_OUTPUT, at, "a path of inline %s ends without .return or .error, it returns 0", name.Value())
+		}
+	}
+}
+
+// flow of the statements of a block, from the paths that reach it to the paths that leave it
+func (c *checker) flow(name text.Symbol, block parser.CSTNode, paths []flowPath) []flowPath {
+	for i, stmt := range block.Children() {
+		live := []flowPath{}
+		for _, p := range paths {
+			if !p.ended {
+				live = append(live, p)
+			}
+		}
+		if len(live) == 0 {
+			if i > 0 {
+				c.report(DEAD_CODE, firstSymbol(stmt), "unreachable statement in %s, every path ends before it", name.Value())
+			}
+			return paths
+		}
+
+		next := []flowPath{}
+		for _, p := range paths {
+			if p.ended {
+				next = append(next, p)
+			}
+		}
+		switch stmt.ID() {
+		case STMT_OUT, STMT_OUTR, STMT_RET, STMT_ERROR:
+			for _, p := range live {
+				next = append(next, flowPath{ended: true, output: true, silentAt: p.silentAt})
+			}
+		case STMT_EMIT, STMT_BITS:
+			for _, p := range live {
+				next = append(next, flowPath{output: true, silentAt: p.silentAt})
+			}
+		case STMT_BRANCH:
+			children := stmt.Children()
+			taken := c.flow(name, children[1], live)
+			notTaken := live
+			if len(children) > 2 {
+				notTaken = c.flow(name, children[2], live)
+			}
+			//the branch is where a path goes silent if only one of its sides has no output
+			if isSilent(taken) != isSilent(notTaken) {
+				at := firstSymbol(stmt)
+				taken, notTaken = silentAt(taken, at), silentAt(notTaken, at)
+			}
+			next = append(next, taken...)
+			next = append(next, notTaken...)
+		case STMT_FOR, STMT_WHILE:
+			//the loop may run any number of times, but a loop with an output is meant to output:
+			//the paths through it or around it are not reported as silent
+			looped := live
+			for _, k := range stmt.Children() {
+				if k.ID() == STMT_BLOCK {
+					looped = c.flow(name, k, live)
+				}
+			}
+			loopOutput := false
+			for _, p := range looped {
+				loopOutput = loopOutput || p.output
+			}
+			for _, p := range append(looped, live...) {
+				if !p.ended && loopOutput {
+					p = flowPath{output: true}
+				}
+				next = append(next, p)
+			}
+		default:
+			next = append(next, live...)
+		}
+		paths = distinctPaths(next)
+	}
+	return paths
+}
+
+// isSilent is true if one of the paths has neither ended nor output
+func isSilent(paths []flowPath) bool {
+	for _, p := range paths {
+		if !p.ended && !p.output {
+			return true
+		}
+	}
+	return false
+}
+
+// silentAt mark the silent paths that have no branch yet
+func silentAt(paths []flowPath, at text.Symbol) []flowPath {
+	marked := []flowPath{}
+	for _, p := range paths {
+		if !p.ended && !p.output && p.silentAt.ID() == text.NONE {
+			p.silentAt = at
+		}
+		marked = append(marked, p)
+	}
+	return marked
+}
+
+// distinctPaths remove the paths equal to another one, the number of paths grows with the branches
+func distinctPaths(paths []flowPath) []flowPath {
+	seen := map[flowPath]bool{}
+	out := []flowPath{}
+	for _, p := range paths {
+		if !seen[p] {
+			seen[p] = true
+			out = append(out, p)
+		}
+	}
+	return out
+}
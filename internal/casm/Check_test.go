@@ -0,0 +1,32 @@
+package casm
+
+import (
+	"testing"
+)
+
+func TestStaticCheck(t *testing.T) {
+	expected := []struct {
+		kind uint32
+		line uint32
+	}{
+		{UNUSED_PARAM, 16}, {UNTYPED_PARAM, 21}, {DEAD_CODE, 30}, {NO_OUTPUT, 36},
+	}
+	lang, files := loadTestLanguage(t, "check/mistakes.casm")
+	found := lang.Diagnostics()
+	if len(found) != len(expected) {
+		t.Fatalf("Expected %d diagnostics, found %v", len(expected), found)
+	}
+	for i, d := range found {
+		_, line, _ := files[d.FileIndex()].FindPosition(d.At())
+		if d.Kind() != expected[i].kind || line+1 != expected[i].line {
+			t.Errorf("Expected diagnostic %d of kind %d at line %d, found kind %d at line %d: %s", i, expected[i].kind, expected[i].line, d.Kind(), line+1, d.Error())
+		}
+	}
+
+	for _, clean := range []string{"loops/loops.casm", "emit/emit.casm", "evscpu/evscpu.casm", "optional/z80.casm"} {
+		lang, _ := loadTestLanguage(t, clean)
+		if found := lang.Diagnostics(); len(found) > 0 {
+			t.Errorf("Expected no diagnostics for %s, found %v", clean, found)
+		}
+	}
+}
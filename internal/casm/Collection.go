@@ -0,0 +1,169 @@
+package casm
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aleferri/casmeleon/pkg/expr"
+	"github.com/aleferri/casmvm/pkg/opcodes"
+	"github.com/aleferri/casmvm/pkg/operators"
+	"github.com/aleferri/casmvm/pkg/vmex"
+)
+
+// tags of the atoms that refer to a collection of values instead of being a value
+const (
+	tableTag = 4
+	setTag   = 5
+)
+
+// isCollection is true if the atom is a table or a set, that can only be an operand of .get, .in and .len
+func isCollection(a expr.Atom) bool {
+	return a.Tag() == tableTag || a.Tag() == setTag
+}
+
+// notValue is the error for a collection used where a value is needed
+func notValue(a expr.Atom) error {
+	return errors.New(a.Raw() + " is not a value, a table or a set can only be used with .get, .in and .len")
+}
+
+// collectionValues of a table or of a set, with what it is for the errors and the function that looks them up
+func (lang *Language) collectionValues(a expr.Atom) (string, []int64, error) {
+	switch a.Tag() {
+	case tableTag:
+		t := lang.tables[a.Value()]
+		return "table " + t.name, t.values, nil
+	case setTag:
+		set := lang.sets[a.Value()]
+		if set.members == nil {
+			return "", nil, errors.New("The builtin set " + set.name + " has no values to use")
+		}
+		values := []int64{}
+		for _, v := range set.values {
+			values = append(values, int64(v))
+		}
+		return "set " + set.name, values, nil
+	}
+	return "", nil, errors.New(a.Raw() + " is neither a table nor a set")
+}
+
+// makeLookup build the function that returns the value at an index: a chain of tests of the index,
+// that ends with an error if the index is outside of the values
+func (lang *Language) makeLookup(what string, values []int64) int32 {
+	//local 0 is the index, 1 the index tested, 2 the result of the test, 3 the value
+	list := []opcodes.Opcode{}
+	for i, v := range values {
+		list = append(list,
+			opcodes.MakeIConst(1, int64(i)),
+			opcodes.MakeBinaryOp(2, "==", opcodes.IntShape, 0, 1, operators.BinaryOperatorsSymbols["=="]),
+			opcodes.MakeBranch(0, 2, 2),
+			opcodes.MakeIConst(3, v),
+			opcodes.MakeLeave(3),
+		)
+	}
+	list = append(list, opcodes.MakeSigError(fmt.Sprintf("Index outside of %s of %d values, index ", what, len(values)), 0), opcodes.MakeLeave(0))
+	return lang.AssignFrame(vmex.MakeCallable("."+what, []string{"index"}, list), "."+what)
+}
+
+// lookupFrame of a collection, the function of a set is built the first time the set is indexed
+func (lang *Language) lookupFrame(a expr.Atom, what string, values []int64) int32 {
+	if a.Tag() == tableTag {
+		return lang.tables[a.Value()].frame
+	}
+	frame, found := lang.setLookups[uint32(a.Value())]
+	if !found {
+		frame = lang.makeLookup(what, values)
+		lang.setLookups[uint32(a.Value())] = frame
+	}
+	return frame
+}
+
+// isKnown is true if the value of the atom is known at compile time
+func isKnown(a expr.Atom) bool {
+	return a.Tag() == 0 || a.Tag() == 2
+}
+
+// compileGet compile collection .get index, the value at index of a table or the index-th value of a set in order
+// of declaration. A known index is replaced by the value, otherwise the value is looked up when the line is assembled
+func compileGet(lang *Language, fn *ListingContext, listing *[]opcodes.Opcode, status *expr.Converter) error {
+	index := status.Pop()
+	collection := status.Pop()
+	if !isCollection(collection) {
+		return errors.New(".get needs a table or a set on its left, found " + collection.Raw())
+	}
+	if isCollection(index) {
+		return notValue(index)
+	}
+	what, values, err := lang.collectionValues(collection)
+	if err != nil {
+		return err
+	}
+
+	if isKnown(index) {
+		if index.Value() < 0 || index.Value() >= int64(len(values)) {
+			return fmt.Errorf("Index %d outside of %s of %d values", index.Value(), what, len(values))
+		}
+		fn.dropKnown(listing, index)
+		fn.pushKnown(listing, status, expr.MakeLiteral(collection.Raw(), values[index.Value()]))
+		return nil
+	}
+	resultLocal := status.LabelLocal()
+	frame := lang.lookupFrame(collection, what, values)
+	*listing = append(*listing, opcodes.MakeEnter([]uint16{resultLocal}, uint32(frame), []uint16{index.Local()}))
+	status.Push(expr.MakeLocal(collection.Raw(), 0, resultLocal))
+	return nil
+}
+
+// compileIn compile value .in collection, 1 if the value is one of the values of the table or of the set, 0 otherwise
+func compileIn(lang *Language, fn *ListingContext, listing *[]opcodes.Opcode, status *expr.Converter) error {
+	collection := status.Pop()
+	value := status.Pop()
+	if isCollection(value) {
+		return notValue(value)
+	}
+	if !isCollection(collection) {
+		return errors.New(".in needs a table or a set on its right, found " + collection.Raw())
+	}
+	_, values, err := lang.collectionValues(collection)
+	if err != nil {
+		return err
+	}
+
+	if isKnown(value) {
+		found := int64(0)
+		for _, v := range values {
+			if v == value.Value() {
+				found = 1
+			}
+		}
+		fn.dropKnown(listing, value)
+		fn.pushKnown(listing, status, expr.MakeLiteral(collection.Raw(), found))
+		return nil
+	}
+
+	result := status.LabelLocal()
+	*listing = append(*listing, opcodes.MakeIConst(result, 0))
+	for _, v := range values {
+		test, eq := status.LabelLocal(), status.LabelLocal()
+		*listing = append(*listing,
+			opcodes.MakeIConst(test, v),
+			opcodes.MakeBinaryOp(eq, "==", opcodes.IntShape, value.Local(), test, operators.BinaryOperatorsSymbols["=="]),
+			opcodes.MakeBinaryOp(result, "|", opcodes.IntShape, result, eq, operators.BinaryOperatorsSymbols["|"]),
+		)
+	}
+	status.Push(expr.MakeLocal(collection.Raw(), 0, result))
+	return nil
+}
+
+// compileLen compile .len collection, the number of values of a table or of a set, known at compile time
+func compileLen(lang *Language, fn *ListingContext, listing *[]opcodes.Opcode, status *expr.Converter) error {
+	collection := status.Pop()
+	if !isCollection(collection) {
+		return errors.New(".len needs a table or a set, found " + collection.Raw())
+	}
+	_, values, err := lang.collectionValues(collection)
+	if err != nil {
+		return err
+	}
+	fn.pushKnown(listing, status, expr.MakeLiteral(collection.Raw(), int64(len(values))))
+	return nil
+}
@@ -0,0 +1,96 @@
+package casm
+
+import (
+	"fmt"
+
+	"github.com/aleferri/casmeleon/pkg/parser"
+)
+
+// Table of constants declared with .table, indexed with .get
+type Table struct {
+	name   string
+	values []int64
+	frame  int32 //function that returns the value at an index, for an index known only at run time
+}
+
+// Name of the table
+func (t Table) Name() string {
+	return t.name
+}
+
+// Values of the table, in order
+func (t Table) Values() []int64 {
+	return t.values
+}
+
+// declaredName is true if name is already a constant or a table
+func (lang *Language) declaredName(name string) bool {
+	if _, found := lang.consts[name]; found {
+		return true
+	}
+	_, found := lang.TableByName(name)
+	return found
+}
+
+// ConstOf return the value of a constant declared with .const
+func (lang *Language) ConstOf(name string) (int64, bool) {
+	v, found := lang.consts[name]
+	return v, found
+}
+
+// TableByName return the index of the table with the specified name
+func (lang *Language) TableByName(name string) (int, bool) {
+	for i, t := range lang.tables {
+		if t.name == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// constantValue of an expression of the language file, outside of any body
+func (lang *Language) constantValue(node parser.CSTNode, what string) (int64, error) {
+	fn := MakeListingContext([]string{})
+	v, known, err := constantOf(lang, fn, node)
+	if err != nil {
+		return 0, errorIn(errorAt(err, firstSymbol(node)), what)
+	}
+	if !known {
+		return 0, semanticError(firstSymbol(node), "The value of "+what+" must be known when the language is loaded")
+	}
+	return v, nil
+}
+
+// PruneToConst evaluate a .const, the constants and the tables declared before it can be used
+func PruneToConst(lang *Language, node parser.CSTNode) error {
+	name := node.Symbols()[1].Value()
+	if lang.declaredName(name) {
+		return semanticError(node.Symbols()[1], "Constant "+name+" is already declared")
+	}
+	v, err := lang.constantValue(node.Children()[0], ".const "+name)
+	if err != nil {
+		return err
+	}
+	lang.consts[name] = v
+	return nil
+}
+
+// PruneToTable evaluate the values of a .table and build the function that looks them up at run time
+func PruneToTable(lang *Language, node parser.CSTNode) error {
+	name := node.Symbols()[1].Value()
+	if lang.declaredName(name) {
+		return semanticError(node.Symbols()[1], "Table "+name+" is already declared")
+	}
+	values := []int64{}
+	for i, k := range node.Children() {
+		v, err := lang.constantValue(k, fmt.Sprintf("the value %d of .table %s", i, name))
+		if err != nil {
+			return err
+		}
+		values = append(values, v)
+	}
+
+	frame := lang.makeLookup("table "+name, values)
+	lang.tables = append(lang.tables, Table{name: name, values: values, frame: frame})
+	return nil
+}
@@ -0,0 +1,77 @@
+package casm
+
+import (
+	"strings"
+)
+
+// maxErrors is the number of errors reported before the analysis of the language files stops
+var maxErrors = 20
+
+// SetMaxErrors change the number of errors reported before the analysis of the language files stops, at least 1
+func SetMaxErrors(max int) {
+	if max < 1 {
+		max = 1
+	}
+	maxErrors = max
+}
+
+// ErrorList is the list of the errors found in the language files, up to a maximum
+type ErrorList struct {
+	errors  []error
+	max     int
+	dropped bool //an error was rejected because the list was full
+}
+
+// MakeErrorList with the current maximum number of errors
+func MakeErrorList() *ErrorList {
+	return &ErrorList{errors: []error{}, max: maxErrors}
+}
+
+// Add an error, an error list is merged. Add is false if the error is left out because the list is full,
+// the analysis should stop there
+func (l *ErrorList) Add(err error) bool {
+	if other, isList := err.(*ErrorList); isList {
+		for _, e := range other.errors {
+			l.Add(e)
+		}
+		l.dropped = l.dropped || other.dropped
+		return !l.dropped
+	}
+	if l.Full() {
+		l.dropped = true
+		return false
+	}
+	l.errors = append(l.errors, err)
+	return true
+}
+
+// Full is true if the list has reached its maximum
+func (l *ErrorList) Full() bool {
+	return len(l.errors) >= l.max
+}
+
+// Truncated is true if an error was left out because the list was full
+func (l *ErrorList) Truncated() bool {
+	return l.dropped
+}
+
+// Errors in the order they were found
+func (l *ErrorList) Errors() []error {
+	return l.errors
+}
+
+func (l *ErrorList) Error() string {
+	messages := []string{}
+	for _, e := range l.errors {
+		messages = append(messages, e.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// orNil is the list, or nil if there are no errors
+func (l *ErrorList) orNil() error {
+	if len(l.errors) == 0 {
+		return nil
+	}
+	return l
+}
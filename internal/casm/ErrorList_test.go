@@ -0,0 +1,59 @@
+package casm
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/aleferri/casmeleon/pkg/parser"
+	"github.com/aleferri/casmeleon/pkg/text"
+)
+
+func TestErrorRecovery(t *testing.T) {
+	src := `.set Regs { A; B; A; }
+.opcode ST {{ # n }} .with ( n Ints ) -> { .out [ n ]; }
+.opcode LD {{ # n }} .with ( n : Ints ) -> { .out [ m ]; }
+.opcode NOP {{ }} .with ( ) -> { .out [ 0xEA ]; }
+.const C = 1;
+.const C = 2;
+`
+	parse := func() (parser.CSTNode, error) {
+		repo := text.BuildSource("recovery")
+		return ParseCasm(BuildStream(bufio.NewReader(strings.NewReader(src)), &repo), repo)
+	}
+
+	root, parseErr := parse()
+	parseList, ok := parseErr.(*ErrorList)
+	if !ok || len(parseList.Errors()) != 1 {
+		t.Fatalf("Expected one syntax error, found %v", parseErr)
+	}
+	lang, semErr := MakeLanguage(root, 8)
+	semList, ok := semErr.(*ErrorList)
+	if !ok || len(semList.Errors()) != 3 {
+		t.Fatalf("Expected three semantic errors, found %v", semErr)
+	}
+	if len(lang.FilterOpcodesByName("NOP").Candidates()) != 1 {
+		t.Error("Expected NOP to be declared after the errors")
+	}
+
+	if semList.Truncated() {
+		t.Error("Expected no error to be left out")
+	}
+
+	SetMaxErrors(3)
+	defer SetMaxErrors(20)
+	root, _ = parse()
+	_, semErr = MakeLanguage(root, 8)
+	semList, ok = semErr.(*ErrorList)
+	if !ok || len(semList.Errors()) != 3 || semList.Truncated() {
+		t.Errorf("Expected exactly three errors, none left out, found %v", semErr)
+	}
+
+	SetMaxErrors(2)
+	root, _ = parse()
+	_, semErr = MakeLanguage(root, 8)
+	semList, ok = semErr.(*ErrorList)
+	if !ok || len(semList.Errors()) != 2 || !semList.Truncated() {
+		t.Errorf("Expected the errors to stop at two, found %v", semErr)
+	}
+}
@@ -2,7 +2,9 @@ package casm
 
 import (
 	"errors"
+	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/aleferri/casmeleon/pkg/expr"
 	"github.com/aleferri/casmeleon/pkg/parser"
@@ -16,25 +18,27 @@ const USE_THIS_ADDR = 1
 // WalkCSTExpression walk the concrete syntax tree of an expression to convert it into SSA form
 func WalkCSTExpression(lang *Language, params []string, types []uint32, node parser.CSTNode) (expr.Converter, error) {
 	listing := []opcodes.Opcode{}
-	status := expr.MakeConverter(node.Symbols(), uint16(len(params)))
+	fn := MakeListingContext(params)
+	status := expr.MakeConverter(node.Symbols(), fn.nextLocal)
 
-	err := CompileTerm(lang, params, &listing, &status)
+	err := CompileTerm(lang, fn, &listing, &status)
 	for len(status.Queue()) > 0 && err == nil {
-		err = CompileTerm(lang, params, &listing, &status)
+		err = CompileTerm(lang, fn, &listing, &status)
 	}
 	return status, err
 }
 
 var Precedence = map[string]int{
 	"||": 0, "&&": 0,
-	"!=": 1, "==": 1, ">=": 1, "<=": 1, "<": 1, ">": 1, ".in": 1, ".get": 1,
+	"!=": 1, "==": 1, ">=": 1, "<=": 1, "<": 1, ">": 1, ".in": 1,
 	"<<": 2, ">>": 2, "+": 2, "-": 2, "|": 2,
 	"*": 3, "/": 3, "%": 3, "^": 3, "&": 3,
 	"!": 4, "~": 4, ".len": 4,
+	".get": 5, //indexing binds tighter than any other operator: A + T .get i is A + (T .get i)
 }
 
 // CompileTerm compile a <Term> of the expression: either <Identifier> | <Integer> | <UnaryOp> | <ParensExpr> | <InlineCall>
-func CompileTerm(lang *Language, params []string, listing *[]opcodes.Opcode, status *expr.Converter) error {
+func CompileTerm(lang *Language, fn *ListingContext, listing *[]opcodes.Opcode, status *expr.Converter) error {
 	if status.IsEmptyQueue() {
 		return nil
 	}
@@ -44,30 +48,34 @@ func CompileTerm(lang *Language, params []string, listing *[]opcodes.Opcode, sta
 	switch q.ID() {
 	case text.Number:
 		{
-			base := 10
-			str := q.Value()
-			if len(str) > 1 {
-				if str[1] == 'b' {
-					base = 2
-					str = str[2:]
-				} else if str[1] == 'x' {
-					base = 16
-					str = str[2:]
-				}
-			}
-			v, e := strconv.ParseInt(str, base, 32)
+			v, e := lang.parseNumber(q.Value())
 			if e != nil {
-				return e
+				return errorAt(e, q)
 			}
-			atom := status.LabelAtom(expr.MakeLiteral(str, v))
-			*listing = append(*listing, opcodes.MakeIConst(atom.Local(), v))
-			status.Push(atom)
+			fn.pushKnown(listing, status, expr.MakeLiteral(q.Value(), v))
 			return nil
 		}
 	case text.Identifier:
 		{
-			for i, p := range params {
+			if q.Value() == ".len" {
+				err := CompileTerm(lang, fn, listing, status)
+				if err != nil {
+					return err
+				}
+				return errorAt(compileLen(lang, fn, listing, status), q)
+			}
+			if v, found := fn.lookup(q.Value()); found {
+				if v.known {
+					fn.pushKnown(listing, status, expr.MakeLiteral(q.Value(), v.value))
+					return nil
+				}
+				fn.dynamic = true
+				status.Push(expr.MakeLocal(q.Value(), 0, v.local))
+				return nil
+			}
+			for i, p := range fn.params {
 				if p == q.Value() {
+					fn.dynamic = true
 					status.Push(expr.MakeParameter(p, int64(i), uint16(i)))
 					if p == ".addr" {
 						status.SetFlag(USE_THIS_ADDR)
@@ -75,24 +83,42 @@ func CompileTerm(lang *Language, params []string, listing *[]opcodes.Opcode, sta
 					return nil
 				}
 			}
+			if v, found := lang.ConstOf(q.Value()); found {
+				fn.pushKnown(listing, status, expr.MakeLiteral(q.Value(), v))
+				return nil
+			}
+			if index, found := lang.TableByName(q.Value()); found {
+				status.Push(expr.MakeTable(q.Value(), int64(index)))
+				return nil
+			}
 			t, f := lang.SetOf(q.Value())
 			//sets 0 and 1 are the builtins _FormatLabels and Ints, whose valueOf never
 			//returns -1: without this guard Contains is true for any string and an
 			//unknown identifier silently compiles to the constant 0
 			if f && t.ID() > 1 {
 				refId := t.valueOf(q.Value())
-				atom := status.LabelAtom(expr.MakeMember(q.Value(), int64(refId)))
-				*listing = append(*listing, opcodes.MakeIConst(atom.Local(), atom.Value()))
-				status.Push(atom)
+				fn.pushKnown(listing, status, expr.MakeMember(q.Value(), int64(refId)))
 				return nil
 			}
-			return errors.New("Parameter " + q.Value() + " not found")
+			if set, found := lang.SetByName(q.Value()); found {
+				status.Push(expr.MakeSet(q.Value(), int64(set.ID())))
+				return nil
+			}
+			if lang.prefixedNumber(q.Value()) {
+				v, e := lang.parseNumber(q.Value())
+				if e != nil {
+					return errorAt(e, q)
+				}
+				fn.pushKnown(listing, status, expr.MakeLiteral(q.Value(), v))
+				return nil
+			}
+			return semanticError(q, "Parameter "+q.Value()+" not found")
 		}
 	case text.RoundOpen:
 		{
 			var err error = nil
 			for q.ID() != text.RoundClose && err == nil {
-				err = CompileExpression(lang, params, listing, status)
+				err = CompileExpression(lang, fn, listing, status)
 				q = status.Front()
 			}
 			status.Poll()
@@ -100,37 +126,49 @@ func CompileTerm(lang *Language, params []string, listing *[]opcodes.Opcode, sta
 		}
 	case text.OperatorNeg, text.OperatorNot, text.OperatorPlusUnary, text.OperatorMinusUnary:
 		{
-			err := CompileTerm(lang, params, listing, status)
+			err := CompileTerm(lang, fn, listing, status)
 
 			if q.ID() == text.OperatorPlusUnary || err != nil {
 				return err
 			}
 
 			a := status.Pop()
-			resultLocal := status.LabelLocal()
-			status.Push(expr.MakeLocal("local", 0, resultLocal))
-
+			if isCollection(a) {
+				return errorAt(notValue(a), q)
+			}
+			var op, name string
 			switch q.ID() {
 			case text.OperatorNeg:
-				*listing = append(*listing, opcodes.MakeUnaryOp(resultLocal, "com", opcodes.IntShape, a.Local(), operators.UnaryOperatorsSymbols["~"]))
+				op, name = "~", "com"
 			case text.OperatorMinusUnary:
-				*listing = append(*listing, opcodes.MakeUnaryOp(resultLocal, "neg", opcodes.IntShape, a.Local(), operators.UnaryOperatorsSymbols["-"]))
+				op, name = "-", "neg"
 			case text.OperatorNot:
-				*listing = append(*listing, opcodes.MakeUnaryOp(resultLocal, "not", opcodes.IntShape, a.Local(), operators.UnaryOperatorsSymbols["!"]))
+				op, name = "!", "not"
 			}
+			operation := operators.UnaryOperatorsSymbols[op]
+			if lang.fold(fn, listing, status, opcodes.MakeUnaryOp(1, name, opcodes.IntShape, 0, operation), a) {
+				return nil
+			}
+			resultLocal := status.LabelLocal()
+			status.Push(expr.MakeLocal("local", 0, resultLocal))
+			*listing = append(*listing, opcodes.MakeUnaryOp(resultLocal, name, opcodes.IntShape, a.Local(), operation))
 
 			return nil
 		}
 	case text.KeywordExpr:
 		{
 			funcName := status.Poll()
+			fn.dynamic = true
 
 			stack := expr.MakeConverter(status.Queue(), status.LabelLocal())
 
 			q = stack.Poll().WithID(text.Comma) // open paren
+			if stack.Front().ID() == text.RoundClose {
+				q = stack.Poll() // inline without parameters
+			}
 			var err error = nil
 			for q.ID() == text.Comma && err == nil {
-				err = CompileExpression(lang, params, listing, &stack)
+				err = CompileExpression(lang, fn, listing, &stack)
 				q = stack.Poll() //comma or close paren
 			}
 
@@ -141,26 +179,62 @@ func CompileTerm(lang *Language, params []string, listing *[]opcodes.Opcode, sta
 				return err
 			}
 
-			refs := []uint16{}
+			args := []expr.Atom{}
 			for !stack.IsEmptyStack() {
-				refs = append(refs, stack.Pop().Local())
+				args = append(args, stack.Pop())
 			}
 
-			i, j := 0, len(refs)-1
+			i, j := 0, len(args)-1
 
 			for i < j {
-				refs[i], refs[j] = refs[j], refs[i]
+				args[i], args[j] = args[j], args[i]
 				i++
 				j--
 			}
 
 			addr, found := lang.FindAddressOf(funcName.Value())
 			if !found {
-				return errors.New("Cannot find function " + funcName.Value())
+				return semanticError(funcName, "Cannot find function "+funcName.Value())
+			}
+			if err := lang.resolveInline(addr, funcName); err != nil {
+				return err
+			}
+			if err := lang.checkArguments(fn, addr, funcName, args); err != nil {
+				return err
+			}
+			refs := []uint16{}
+			for _, a := range args {
+				refs = append(refs, a.Local())
+			}
+			//an .error of the inline is raised by the host, that traces it back to the statement
+			for _, s := range lang.inlines[addr].errors {
+				s.param = -1
+				if s.origin == "" {
+					s.origin = funcName.Value()
+				}
+				fn.signals = append(fn.signals, s)
 			}
 
+			//the inline returns its slots after the value: each one is bound to a
+			//slot of this body, so a .warning or an .emit in the inline reaches the host
 			retLabel := status.LabelLocal()
-			call := opcodes.MakeEnter([]uint16{retLabel}, addr, refs)
+			rets := []uint16{retLabel}
+			for _, calleeSlot := range lang.fnSlots[addr] {
+				signal := calleeSlot.signal
+				signal.param = -1
+				origin := calleeSlot.origin
+				if origin == "" {
+					origin = funcName.Value()
+				}
+				var slot Slot
+				if calleeSlot.emit {
+					slot = fn.takeEmit(origin)
+				} else {
+					slot = fn.takeSlot(signal, origin)
+				}
+				rets = append(rets, slot.flag, slot.value)
+			}
+			call := opcodes.MakeEnter(rets, addr, refs)
 
 			*listing = append(*listing, call)
 			status.Push(expr.MakeLocal("ret", 0, retLabel))
@@ -172,17 +246,16 @@ func CompileTerm(lang *Language, params []string, listing *[]opcodes.Opcode, sta
 
 func ReduceBinaryExpression(op string, listing *[]opcodes.Opcode, status *expr.Converter) expr.Atom {
 	resultLocal := status.LabelLocal()
-	operation := operators.BinaryOperatorsSymbols[op]
 	b := status.Pop()
 	a := status.Pop()
 	res := expr.MakeLocal("local", 0, resultLocal)
-	*listing = append(*listing, opcodes.MakeBinaryOp(resultLocal, op, opcodes.IntShape, a.Local(), b.Local(), operation))
+	*listing = append(*listing, opcodes.MakeBinaryOp(resultLocal, op, opcodes.IntShape, a.Local(), b.Local(), operators.BinaryOperatorsSymbols[op]))
 	status.Push(res)
 	return res
 }
 
 // CompileFactor compile the left associativity part of the expression
-func CompileFactor(lang *Language, params []string, listing *[]opcodes.Opcode, status *expr.Converter) error {
+func CompileFactor(lang *Language, fn *ListingContext, listing *[]opcodes.Opcode, status *expr.Converter) error {
 	if status.IsEmptyQueue() {
 		return nil
 	}
@@ -196,14 +269,13 @@ func CompileFactor(lang *Language, params []string, listing *[]opcodes.Opcode, s
 	}
 
 	status.Poll()
-	err := CompileTerm(lang, params, listing, status)
+	err := CompileTerm(lang, fn, listing, status)
 	if err != nil {
 		return err
 	}
 
 	if status.IsEmptyQueue() {
-		ReduceBinaryExpression(opVal, listing, status)
-		return nil
+		return errorAt(reduceBinary(lang, fn, opVal, listing, status), operator)
 	}
 
 	other := status.Front()
@@ -212,21 +284,123 @@ func CompileFactor(lang *Language, params []string, listing *[]opcodes.Opcode, s
 	seqPrec, isOp := Precedence[seq]
 
 	if isOp && seqPrec > opPrec {
-		err = CompileFactor(lang, params, listing, status)
+		err = CompileFactor(lang, fn, listing, status)
 		if err != nil {
 			return err
 		}
 	}
-	ReduceBinaryExpression(opVal, listing, status)
+	err = errorAt(reduceBinary(lang, fn, opVal, listing, status), operator)
+	if err != nil {
+		return err
+	}
 
-	return CompileFactor(lang, params, listing, status)
+	return CompileFactor(lang, fn, listing, status)
 }
 
-func CompileExpression(lang *Language, params []string, listing *[]opcodes.Opcode, status *expr.Converter) error {
-	err := CompileTerm(lang, params, listing, status)
-	if err != nil || status.IsEmptyQueue() {
+// reduceBinary the two operands on top of the stack, the operators that are not arithmetic have their own rules
+func reduceBinary(lang *Language, fn *ListingContext, op string, listing *[]opcodes.Opcode, status *expr.Converter) error {
+	switch op {
+	case ".get":
+		return compileGet(lang, fn, listing, status)
+	case ".in":
+		return compileIn(lang, fn, listing, status)
+	}
+	b := status.Pop()
+	a := status.Pop()
+	for _, operand := range []expr.Atom{a, b} {
+		if isCollection(operand) {
+			return notValue(operand)
+		}
+	}
+	//a division by zero is left to the VM, that reports it when the line is assembled
+	byZero := (op == "/" || op == "%") && isKnown(b) && b.Value() == 0
+	if !byZero && lang.fold(fn, listing, status, opcodes.MakeBinaryOp(2, op, opcodes.IntShape, 0, 1, operators.BinaryOperatorsSymbols[op]), a, b) {
+		return nil
+	}
+	status.Push(a)
+	status.Push(b)
+	ReduceBinaryExpression(op, listing, status)
+	return nil
+}
+
+func CompileExpression(lang *Language, fn *ListingContext, listing *[]opcodes.Opcode, status *expr.Converter) error {
+	err := CompileTerm(lang, fn, listing, status)
+	if err == nil && !status.IsEmptyQueue() {
+		err = CompileFactor(lang, fn, listing, status)
+	}
+	if err != nil || status.IsEmptyStack() {
 		return err
 	}
 
-	return CompileFactor(lang, params, listing, status)
+	//a table or a set is not a value
+	top := status.Pop()
+	status.Push(top)
+	if isCollection(top) {
+		return notValue(top)
+	}
+	return nil
+}
+
+// parseNumber of the language file, 64 bits wide: in a base declared by .num, binary and hexadecimal with the
+// 0b and 0x prefixes, or decimal. A '_' can separate two digits. The numbers above 2^63-1, up to 2^64-1, wrap
+// around to negative values as in the two's complement: 0xFFFFFFFFFFFFFFFF is -1
+func (lang *Language) parseNumber(str string) (int64, error) {
+	var first error
+	for _, c := range lang.numberCandidates(str) {
+		v, err := parseDigits(c.digits, c.base)
+		if err == nil {
+			return int64(v), nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	if errors.Is(first, strconv.ErrRange) {
+		return 0, fmt.Errorf("Number %s does not fit in 64 bits", str)
+	}
+	return 0, fmt.Errorf("Invalid number %s", str)
+}
+
+// numberCandidate is a way to read a number: its digits in a base
+type numberCandidate struct {
+	digits string
+	base   int
+}
+
+// numberCandidates of a number, in order: the bases declared by .num whose prefix and suffix it has, then
+// the 0b and 0x prefixes, then decimal. The first one whose digits are valid wins
+func (lang *Language) numberCandidates(str string) []numberCandidate {
+	out := []numberCandidate{}
+	for _, base := range lang.numberBases {
+		affixes := len(base.prefix) + len(base.suffix)
+		if len(str) <= affixes || !lang.hasAffix(str, base.prefix, strings.HasPrefix) || !lang.hasAffix(str, base.suffix, strings.HasSuffix) {
+			continue
+		}
+		out = append(out, numberCandidate{digits: str[len(base.prefix) : len(str)-len(base.suffix)], base: int(base.n)})
+	}
+	if strings.HasPrefix(str, "0b") {
+		out = append(out, numberCandidate{digits: str[2:], base: 2})
+	} else if strings.HasPrefix(str, "0x") {
+		out = append(out, numberCandidate{digits: str[2:], base: 16})
+	}
+	return append(out, numberCandidate{digits: str, base: 10})
+}
+
+// parseDigits of an unsigned number up to 64 bits, the '_' between two digits are skipped
+func parseDigits(digits string, base int) (uint64, error) {
+	if strings.HasPrefix(digits, "_") || strings.HasSuffix(digits, "_") || strings.Contains(digits, "__") {
+		return 0, strconv.ErrSyntax
+	}
+	return strconv.ParseUint(strings.ReplaceAll(digits, "_", ""), base, 64)
+}
+
+// prefixedNumber is true if the identifier starts with the prefix of a base declared by .num, as $FF: the
+// prefixes that are not digits make the number an identifier for the scanner of the language file
+func (lang *Language) prefixedNumber(str string) bool {
+	for _, base := range lang.numberBases {
+		if base.prefix != "" && len(str) > len(base.prefix) && lang.hasAffix(str, base.prefix, strings.HasPrefix) {
+			return true
+		}
+	}
+	return false
 }
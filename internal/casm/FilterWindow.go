@@ -7,10 +7,10 @@ type FilterWindow struct {
 	filtered []Opcode
 }
 
-func (win FilterWindow) FilterByFormat(format []uint32, types []uint32) FilterWindow {
+func (win FilterWindow) FilterByFormat(format []uint32, types []uint32, operands []string) FilterWindow {
 	wnd := FilterWindow{}
 	for _, op := range win.filtered {
-		if op.Accept(format, types) {
+		if op.Accept(format, types, operands) {
 			wnd.filtered = append(wnd.filtered, op)
 		}
 	}
@@ -0,0 +1,138 @@
+package casm
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+
+	"github.com/aleferri/casmeleon/pkg/parser"
+	"github.com/aleferri/casmeleon/pkg/text"
+)
+
+// casmLoader reads a language file and the files it includes, each one once
+type casmLoader struct {
+	files  []*text.Source  //read files, in the order of their file index
+	loaded map[string]bool //absolute paths of the files already read
+	errs   *ErrorList      //errors of all the files
+}
+
+// LoadCasm parse a language file and the language files it includes. The declarations of an included file
+// take the place of its .include, a file already included is skipped and the paths are relative to the file
+// that includes them. The sources are in the order of the file index of their symbols, for the error reports
+func LoadCasm(fileName string) (parser.CSTNode, []*text.Source, error) {
+	loader := casmLoader{files: []*text.Source{}, loaded: map[string]bool{}, errs: MakeErrorList()}
+	root := parser.BuildBranch([]text.Symbol{}, ROOT_NODE)
+	err := loader.load(fileName, root)
+	if err != nil {
+		return root, loader.files, err
+	}
+	return root, loader.files, loader.errs.orNil()
+}
+
+// load the declarations of a file into root, the error is returned only if the file cannot be read:
+// the errors inside the file are collected and the parts without errors are loaded anyway
+func (l *casmLoader) load(fileName string, root *parser.CSTBranch) error {
+	abs, err := filepath.Abs(fileName)
+	if err != nil {
+		return err
+	}
+	if l.loaded[abs] {
+		return nil
+	}
+	l.loaded[abs] = true
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	repo := text.BuildIndexedSource(fileName, uint32(len(l.files)))
+	l.files = append(l.files, &repo)
+	fileRoot, err := ParseCasm(BuildStream(bufio.NewReader(file), &repo), repo)
+	if err != nil && !l.errs.Add(err) {
+		return nil
+	}
+
+	for _, k := range fileRoot.Children() {
+		if k.ID() != INCLUDE_NODE {
+			root.InsertChild(k, true)
+			continue
+		}
+		quoted := k.Symbols()[1]
+		included := quoted.Value()[1 : len(quoted.Value())-1]
+		if !filepath.IsAbs(included) {
+			included = filepath.Join(filepath.Dir(fileName), included)
+		}
+		index := uint32(len(l.files))
+		err = l.load(included, root)
+		if err != nil && !l.errs.Add(semanticError(quoted, "Cannot include "+quoted.Value()+", "+err.Error())) {
+			return nil
+		}
+		//the include is kept with the index of the file read, to know which file includes which
+		if err == nil && uint32(len(l.files)) > index {
+			syms := append([]text.Symbol{}, k.Symbols()...)
+			root.InsertChild(parser.BuildLeaf(append(syms, text.SymbolEmpty(index)), INCLUDE_NODE), true)
+		}
+		if l.errs.Truncated() {
+			return nil
+		}
+	}
+	return nil
+}
+
+// overrideOpcodes remove the opcodes with the same pattern of op declared in the files that op's file includes,
+// so that a language can replace the opcodes of the languages it includes wherever its .include is. Op is
+// not kept if its own file is included by the file of the opcode with the same pattern; if neither file
+// includes the other there is no way to choose and it is an error
+func (lang *Language) overrideOpcodes(op Opcode) (bool, error) {
+	file := op.symbol.FileIndex()
+	for _, prev := range lang.opcodes {
+		other := prev.symbol.FileIndex()
+		if other == file || !prev.SamePattern(op) || lang.encloses(file, other) {
+			continue
+		}
+		if lang.encloses(other, file) {
+			return false, nil
+		}
+		return false, semanticErrorf(op.symbol, "The opcode %s has the same pattern of an opcode of another file, and neither file includes the other", op.name)
+	}
+
+	kept := lang.opcodes[:0]
+	replaced := map[int32]bool{}
+	for _, prev := range lang.opcodes {
+		if prev.symbol.FileIndex() != file && prev.SamePattern(op) {
+			replaced[prev.frame] = true
+		} else {
+			kept = append(kept, prev)
+		}
+	}
+	lang.opcodes = kept
+
+	//the body of an opcode whose forms are all replaced is never used
+	for _, prev := range lang.opcodes {
+		delete(replaced, prev.frame)
+	}
+	pending := lang.pending[:0]
+	for _, p := range lang.pending {
+		if !replaced[p.opcode.frame] {
+			pending = append(pending, p)
+		}
+	}
+	lang.pending = pending
+	return true, nil
+}
+
+// encloses is true if the file outer includes the file inner, directly or through the files it includes
+func (lang *Language) encloses(outer uint32, inner uint32) bool {
+	for {
+		parent, found := lang.includedBy[inner]
+		if !found {
+			return false
+		}
+		if parent == outer {
+			return true
+		}
+		inner = parent
+	}
+}
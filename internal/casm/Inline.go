@@ -1,7 +1,20 @@
 package casm
 
 import (
+	"sort"
+	"strings"
+
+	"github.com/aleferri/casmeleon/pkg/expr"
 	"github.com/aleferri/casmeleon/pkg/parser"
+	"github.com/aleferri/casmeleon/pkg/text"
+	"github.com/aleferri/casmvm/pkg/vmex"
+)
+
+// Resolution state of an inline
+const (
+	inlineDeclared  = 0 //the body is not compiled yet
+	inlineResolving = 1 //the body is being compiled, a call now is a recursion
+	inlineResolved  = 2 //the body is compiled, or its errors were reported
 )
 
 // Inline is a temporary structure
@@ -9,6 +22,11 @@ type Inline struct {
 	name   string   //name
 	params []string //parameters name
 	types  []uint32 //param types
+	symbol text.Symbol
+	body   parser.CSTNode
+	errors []Signal //.error statements of the body and of the inlines it calls
+	frame  uint32
+	state  int
 }
 
 // PruneToInline remove the header from the inline CST and return Inline and Body CST
@@ -29,10 +47,94 @@ func PruneToInline(lang *Language, op parser.CSTNode) (Inline, parser.CSTNode, e
 	types := []uint32{}
 	for _, arg := range children[0].Children() {
 		name := arg.Symbols()[0].Value()
+		if len(arg.Symbols()) > 3 {
+			return Inline{}, nil, semanticError(arg.Symbols()[0], "Parameter "+name+" of inline "+toks[1].Value()+" cannot have a default value")
+		}
 		params = append(params, name)
 		types = append(types, argsLUT[name])
 	}
 
 	body := children[1]
-	return Inline{name: name.Value(), params: params, types: types}, body, nil
+	return Inline{name: name.Value(), params: params, types: types, symbol: name, body: body}, body, nil
+}
+
+// resolveInline compile the body of the inline at addr, if it is not compiled yet: the inlines are compiled
+// when the first call needs them, so they can be called before their declaration. A call of an inline that
+// is still being compiled is a recursion, that the inlines cannot have
+func (lang *Language) resolveInline(addr uint32, call text.Symbol) error {
+	inline, found := lang.inlines[addr]
+	if !found || inline.state == inlineResolved {
+		return nil
+	}
+	if inline.state == inlineResolving {
+		chain := []string{}
+		for i := len(lang.resolving) - 1; i >= 0; i-- {
+			chain = append([]string{lang.resolving[i]}, chain...)
+			if lang.resolving[i] == inline.name {
+				break
+			}
+		}
+		chain = append(chain, inline.name)
+		return semanticError(call, "Recursive call of inline "+inline.name+": "+strings.Join(chain, " -> "))
+	}
+
+	inline.state = inlineResolving
+	lang.resolving = append(lang.resolving, inline.name)
+	fn, list, _, err := CompileBody(lang, inline.params, inline.types, inline.body, true)
+	lang.resolving = lang.resolving[:len(lang.resolving)-1]
+	inline.state = inlineResolved
+	if err != nil {
+		return errorIn(errorAt(err, inline.symbol), "inline "+inline.name)
+	}
+	lang.fnList[addr] = vmex.MakeCallable(inline.name, inline.params, list)
+	lang.fnSlots[addr] = fn.slots
+	for _, s := range fn.signals {
+		if s.fatal {
+			inline.errors = append(inline.errors, s)
+		}
+	}
+	return nil
+}
+
+// checkArguments of a call of the inline at addr: the number of arguments must be the number of parameters, and
+// an argument that is a member of a set or a parameter of a set must be a member of the set of the parameter
+func (lang *Language) checkArguments(fn *ListingContext, addr uint32, call text.Symbol, args []expr.Atom) error {
+	inline, found := lang.inlines[addr]
+	if !found {
+		return nil
+	}
+	if len(args) != len(inline.params) {
+		return semanticErrorf(call, "Inline %s has %d parameter(s), it is called with %d argument(s)", inline.name, len(inline.params), len(args))
+	}
+
+	for i, a := range args {
+		//the builtin sets accept any value
+		if inline.types[i] <= 1 {
+			continue
+		}
+		set := lang.sets[inline.types[i]]
+		switch a.Tag() {
+		case 1:
+			if fn.types == nil || int(a.Value()) >= len(fn.types) || fn.types[a.Value()] <= 1 {
+				continue
+			}
+			from := lang.sets[fn.types[a.Value()]]
+			names := []string{}
+			for name := range from.members {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				if !set.Contains(name) {
+					return semanticErrorf(call, "Argument %s of inline %s is a member of %s, but %s is not in %s, the set of parameter %s",
+						a.Raw(), inline.name, from.name, name, set.name, inline.params[i])
+				}
+			}
+		case 2:
+			if !set.Contains(a.Raw()) {
+				return semanticErrorf(call, "Argument %s of inline %s is not a member of %s, the set of parameter %s", a.Raw(), inline.name, set.name, inline.params[i])
+			}
+		}
+	}
+	return nil
 }
@@ -1,13 +1,13 @@
 package casm
 
 import (
-	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 
 	"github.com/aleferri/casmeleon/pkg/expr"
 	"github.com/aleferri/casmeleon/pkg/parser"
+	"github.com/aleferri/casmeleon/pkg/text"
 	"github.com/aleferri/casmvm/pkg/opcodes"
 	"github.com/aleferri/casmvm/pkg/vmex"
 )
@@ -19,8 +19,26 @@ type Language struct {
 	opcodes     []Opcode
 	fnList      []vmex.Callable
 	fnNames     []string
-	bigEndian   bool   // little endian if false
-	byteSize    uint32 // 8 is standard byte
+	fnSlots     [][]Slot // slots returned by every function, after its outputs
+	bigEndian   bool     // little endian if false
+	byteSize    uint32   // 8 is standard byte
+	noCase      bool     // mnemonics, set members and number prefixes match ignoring the case
+	noCaseLabel bool     // labels of the source match ignoring the case
+	consts      map[string]int64
+	tables      []Table
+	setLookups  map[uint32]int32 // functions that look up the values of the sets indexed with .get
+	diagnostics []Diagnostic     // mistakes of the bodies found by CheckLanguage
+	inlines     map[uint32]*Inline
+	resolving   []string          // inlines being compiled, the outermost first
+	pending     []pendingBody     // opcode bodies declared and not compiled yet
+	signalCount int               // .error and .warning statements compiled, to number them
+	includedBy  map[uint32]uint32 // file index of the file that includes every included file
+}
+
+// pendingBody of an opcode, compiled after all the declarations
+type pendingBody struct {
+	opcode Opcode //first form of the opcode
+	body   parser.CSTNode
 }
 
 func (l *Language) FindAddressOf(name string) (uint32, bool) {
@@ -57,33 +75,102 @@ func (l *Language) SetByName(s string) (*Set, bool) {
 func (l *Language) FilterOpcodesByName(name string) FilterWindow {
 	wnd := FilterWindow{[]string{}, []Opcode{}}
 	for _, op := range l.opcodes {
-		if op.name == name {
+		if op.name == name || (l.noCase && strings.EqualFold(op.name, name)) {
 			wnd.filtered = append(wnd.filtered, op)
 		}
 	}
 	return wnd
 }
 
+// OpcodeNames return the names of the declared opcodes, each one once, in declaration order
+func (l *Language) OpcodeNames() []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for _, op := range l.opcodes {
+		if !seen[op.name] {
+			seen[op.name] = true
+			names = append(names, op.name)
+		}
+	}
+	return names
+}
+
+// SuggestOpcode return the opcode name closest to a misspelled one, if any is close enough
+func (l *Language) SuggestOpcode(name string) (string, bool) {
+	best := ""
+	bestDistance := len(name)/3 + 1
+	for _, candidate := range l.OpcodeNames() {
+		d := EditDistance(strings.ToUpper(name), strings.ToUpper(candidate))
+		if d <= bestDistance && (best == "" || d < EditDistance(strings.ToUpper(name), strings.ToUpper(best))) {
+			best = candidate
+		}
+	}
+	return best, best != ""
+}
+
+// EditDistance between two strings, counted in insertions, deletions and substitutions of runes
+func EditDistance(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	next := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		next[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			next[j] = prev[j-1] + cost
+			if prev[j]+1 < next[j] {
+				next[j] = prev[j] + 1
+			}
+			if next[j-1]+1 < next[j] {
+				next[j] = next[j-1] + 1
+			}
+		}
+		prev, next = next, prev
+	}
+	return prev[len(rb)]
+}
+
 // NumberPrefixes returns the non-empty prefixes of the declared number bases
 func (lang *Language) NumberPrefixes() []string {
 	out := []string{}
 	for _, base := range lang.numberBases {
 		if base.prefix != "" {
 			out = append(out, base.prefix)
+			//the tokenizer must recognize the prefix in any case
+			if lang.noCase && strings.ToUpper(base.prefix) != base.prefix {
+				out = append(out, strings.ToUpper(base.prefix))
+			}
+			if lang.noCase && strings.ToLower(base.prefix) != base.prefix {
+				out = append(out, strings.ToLower(base.prefix))
+			}
 		}
 	}
 	return out
 }
 
+// hasAffix test the prefix or the suffix of a number, ignoring the case if the language is case insensitive
+func (lang *Language) hasAffix(value string, affix string, test func(string, string) bool) bool {
+	if lang.noCase {
+		return test(strings.ToLower(value), strings.ToLower(affix))
+	}
+	return test(value, affix)
+}
+
 func (lang *Language) ParseUint(value string) (uint64, error) {
 	for _, base := range lang.numberBases {
 		if base.prefix != "" {
-			if !strings.HasPrefix(value, base.prefix) {
+			if !lang.hasAffix(value, base.prefix, strings.HasPrefix) {
 				continue
 			}
 		}
 		if base.suffix != "" {
-			if !strings.HasSuffix(value, base.suffix) {
+			if !lang.hasAffix(value, base.suffix, strings.HasSuffix) {
 				continue
 			}
 		}
@@ -108,6 +195,7 @@ func (lang *Language) AssignFrame(c vmex.Callable, name string) int32 {
 	n := len(lang.fnList)
 	lang.fnList = append(lang.fnList, c)
 	lang.fnNames = append(lang.fnNames, name)
+	lang.fnSlots = append(lang.fnSlots, nil)
 	return int32(n)
 }
 
@@ -127,96 +215,301 @@ func (lang *Language) ByteSize() uint32 {
 	return lang.byteSize
 }
 
+// IsCaseInsensitive is true if mnemonics, set members and number prefixes match ignoring the case
+func (lang *Language) IsCaseInsensitive() bool {
+	return lang.noCase
+}
+
+// LabelsIgnoreCase is true if the labels of the source match ignoring the case
+func (lang *Language) LabelsIgnoreCase() bool {
+	return lang.noCaseLabel
+}
+
+// applyCase declared with .case, the last declaration wins
+func (lang *Language) applyCase(root parser.CSTNode) error {
+	for _, k := range root.Children() {
+		if k.ID() != CASE_NODE {
+			continue
+		}
+		syms := k.Symbols()
+		switch syms[1].Value() {
+		case "sensitive":
+			if len(syms) > 2 {
+				return semanticError(syms[2], "Unexpected "+syms[2].Value()+" after .case sensitive")
+			}
+			lang.noCase, lang.noCaseLabel = false, false
+		case "insensitive":
+			if len(syms) > 2 && syms[2].Value() != "labels" {
+				return semanticError(syms[2], "Expected labels after .case insensitive, found "+syms[2].Value())
+			}
+			lang.noCase, lang.noCaseLabel = true, len(syms) > 2
+		default:
+			return semanticError(syms[1], "The .case must be sensitive or insensitive, found "+syms[1].Value())
+		}
+	}
+	return nil
+}
+
 func MakeLanguage(root parser.CSTNode, byteSize uint32) (Language, error) {
 	return MakeLanguageEndian(root, byteSize, true)
 }
 
 // MakeLanguageEndian builds a language with an explicit byte order for opcodes
-// wider than one byte.
+// wider than one byte. byteSize and bigEndian are the defaults for a language file
+// that does not declare its .atom or .endian
 func MakeLanguageEndian(root parser.CSTNode, byteSize uint32, bigEndian bool) (Language, error) {
-	labels := Set{"_FormatLabels", 0, func(string) int32 { return 0 }}
-	integers := Set{"Ints", 1, func(a string) int32 {
+	layout, err := DeclaredLayout(root, Layout{ByteSize: byteSize, BigEndian: bigEndian})
+	if err != nil {
+		return Language{}, err
+	}
+	return MakeLanguageLayout(root, layout)
+}
+
+// MakeLanguageLayout builds a language with the specified layout, whatever the language file declares
+func MakeLanguageLayout(root parser.CSTNode, layout Layout) (Language, error) {
+	labels := Set{name: "_FormatLabels", index: 0, valueOf: func(string) int32 { return 0 }}
+	integers := Set{name: "Ints", index: 1, valueOf: func(a string) int32 {
 		v, _ := strconv.ParseInt(a, 10, 32)
 		return int32(v)
 	}}
-	lang := Language{[]NumberBase{}, []Set{labels, integers}, []Opcode{}, []vmex.Callable{}, []string{}, bigEndian, byteSize}
+	lang := Language{
+		numberBases: []NumberBase{}, sets: []Set{labels, integers}, opcodes: []Opcode{}, fnList: []vmex.Callable{},
+		fnNames: []string{}, fnSlots: [][]Slot{}, bigEndian: layout.BigEndian, byteSize: layout.ByteSize,
+		consts: map[string]int64{}, tables: []Table{}, setLookups: map[uint32]int32{}, inlines: map[uint32]*Inline{},
+		resolving: []string{}, pending: []pendingBody{}, includedBy: map[uint32]uint32{},
+	}
+
+	//the case option changes the sets, wherever it is declared; after an error the other declarations
+	//are still analyzed, to report as many errors as possible
+	errs := MakeErrorList()
+	caseErr := lang.applyCase(root)
+	if caseErr != nil {
+		errs.Add(caseErr)
+	}
+	//the numbers of the sets, the constants and the defaults can be written in any base, wherever it is declared
 	for _, k := range root.Children() {
-		switch k.ID() {
-		case NUMBER_BASE:
-			{
-				base, err := PruneToNumBase(k)
-				if err != nil {
-					return lang, err
-				}
-				lang.numberBases = append(lang.numberBases, base)
-			}
-		case SET_NODE:
-			{
-				set := PruneToSet(k, uint32(len(lang.sets)))
-				lang.sets = append(lang.sets, set)
-			}
-		case INLINE_NODE:
-			{
-				inline, body, err := PruneToInline(&lang, k)
-				if err != nil {
-					return lang, err
-				}
+		if k.ID() != NUMBER_BASE {
+			continue
+		}
+		base, err := PruneToNumBase(k)
+		if err == nil && (base.n < 2 || base.n > 36) {
+			err = semanticErrorf(k.Symbols()[1], "The base of .num must be between 2 and 36, found %d", base.n)
+		}
+		if err == nil {
+			lang.numberBases = append(lang.numberBases, base)
+		} else if !errs.Add(errorAt(err, firstSymbol(k))) {
+			break
+		}
+	}
 
-				list, _, errBody := CompileListing(&lang, inline.params, body, nil)
-				if errBody != nil {
-					return lang, errBody
-				}
+	//an opcode replaces the ones of the files its file includes, wherever the .include is
+	for _, k := range root.Children() {
+		//.include "file" ; and the file read, added by LoadCasm
+		if k.ID() == INCLUDE_NODE && len(k.Symbols()) > 3 {
+			lang.includedBy[k.Symbols()[3].FileIndex()] = k.Symbols()[0].FileIndex()
+		}
+	}
+
+	for _, k := range root.Children() {
+		if err := lang.declare(k); err != nil && !errs.Add(err) {
+			break
+		}
+	}
+	//the bodies are compiled once everything is declared, so that the declaration order does not matter
+	if !errs.Truncated() {
+		lang.compileBodies(errs)
+	}
+	lang.diagnostics = CheckLanguage(root)
+	return lang, errs.orNil()
+}
 
-				callable := vmex.MakeCallable(inline.name, inline.params, *list)
+// Diagnostics are the mistakes of the opcode and inline bodies found when the language was loaded
+func (lang *Language) Diagnostics() []Diagnostic {
+	return lang.diagnostics
+}
 
-				lang.fnList = append(lang.fnList, callable)
-				lang.fnNames = append(lang.fnNames, inline.name)
+// declare the declaration k of the language file
+func (lang *Language) declare(k parser.CSTNode) error {
+	switch k.ID() {
+	case SET_NODE:
+		{
+			set, err := PruneToSet(lang, k, uint32(len(lang.sets)))
+			if err != nil {
+				return errorAt(err, firstSymbol(k))
 			}
-		case OPCODE_NODE:
-			{
-				opcode, body, err := PruneToOpcode(&lang, k)
+			lang.sets = append(lang.sets, set)
+		}
+	case INLINE_NODE:
+		{
+			inline, _, err := PruneToInline(lang, k)
+			if err != nil {
+				return errorAt(err, firstSymbol(k))
+			}
+			inline.frame = uint32(lang.AssignFrame(vmex.MakeCallable(inline.name, inline.params, []opcodes.Opcode{}), inline.name))
+			lang.inlines[inline.frame] = &inline
+		}
+	case CONST_NODE:
+		{
+			err := PruneToConst(lang, k)
+			if err != nil {
+				return errorAt(err, firstSymbol(k))
+			}
+		}
+	case TABLE_NODE:
+		{
+			err := PruneToTable(lang, k)
+			if err != nil {
+				return errorAt(err, firstSymbol(k))
+			}
+		}
+	case OPCODE_NODE:
+		{
+			forms, body, err := PruneToOpcode(lang, k)
+			if err != nil {
+				return errorAt(err, firstSymbol(k))
+			}
+			kept := []Opcode{}
+			for _, form := range forms {
+				keep, err := lang.overrideOpcodes(form)
 				if err != nil {
-					return lang, err
+					return err
 				}
-				lang.opcodes = append(lang.opcodes, opcode)
-				list, useAddr, errBody := CompileListing(&lang, opcode.params, body, nil)
-				if errBody != nil {
-					fmt.Printf("Arguments were: %v\n", opcode.params)
-					return lang, errors.New("In Opcode " + opcode.name + ":\n" + errBody.Error())
+				if keep {
+					kept = append(kept, form)
 				}
-				lang.fnList[opcode.frame] = vmex.MakeCallable(opcode.name, opcode.params, *list)
-				lang.opcodes[len(lang.opcodes)-1].runList = *list
-				lang.opcodes[len(lang.opcodes)-1].useAddr = useAddr
+			}
+			if len(kept) > 0 {
+				lang.opcodes = append(lang.opcodes, kept...)
+				lang.pending = append(lang.pending, pendingBody{kept[0], body})
+			}
+		}
+	}
+	return nil
+}
+
+// compileBodies of the inlines and of the opcodes, after all the declarations
+func (lang *Language) compileBodies(errs *ErrorList) {
+	for addr := range lang.fnList {
+		if inline, found := lang.inlines[uint32(addr)]; found {
+			if err := lang.resolveInline(uint32(addr), inline.symbol); err != nil && !errs.Add(err) {
+				return
 			}
 		}
+	}
 
+	for _, p := range lang.pending {
+		if err := lang.compileOpcode(p); err != nil && !errs.Add(err) {
+			return
+		}
 	}
-	return lang, nil
+	lang.pending = []pendingBody{}
 }
 
-func CompileListing(lang *Language, params []string, root parser.CSTNode, listing *[]opcodes.Opcode) (*[]opcodes.Opcode, bool, error) {
+// compileOpcode compile the body shared by the forms of an opcode, the forms of an opcode with errors are removed.
+// The body of an opcode replaced by another one with the same pattern is not compiled, it is never run
+func (lang *Language) compileOpcode(p pendingBody) error {
+	opcode := p.opcode
+	fn, list, useAddr, errBody := CompileBody(lang, opcode.params, opcode.paramTypes, p.body, false)
+	if errBody != nil {
+		kept := lang.opcodes[:0]
+		for _, form := range lang.opcodes {
+			if form.frame != opcode.frame {
+				kept = append(kept, form)
+			}
+		}
+		lang.opcodes = kept
+		return errorIn(errorAt(errBody, opcode.symbol), "opcode "+opcode.name)
+	}
+
+	lang.fnList[opcode.frame] = vmex.MakeCallable(opcode.name, opcode.params, list)
+	lang.fnSlots[opcode.frame] = fn.slots
+	for i := range lang.opcodes {
+		form := &lang.opcodes[i]
+		if form.frame == opcode.frame {
+			form.runList = list
+			form.useAddr = useAddr
+			form.signals = fn.signals
+			form.slots = fn.slots
+		}
+	}
+	return nil
+}
+
+// CompileBody compile the body of an opcode or of an inline, types are the sets of the params. The body is compiled twice: the first time
+// finds the slots of the body, the second reserves their locals and produces the listing, so that every
+// leave returns all the slots. Isolated is true for an inline, that returns a value before the slots.
+func CompileBody(lang *Language, params []string, types []uint32, root parser.CSTNode, isolated bool) (*ListingContext, []opcodes.Opcode, bool, error) {
+	first := MakeListingContext(params)
+	first.types = types
+	first.isolated = isolated
+	list, useAddr, err := CompileListing(lang, first, root, nil)
+	if err != nil || len(first.slots) == 0 {
+		if list == nil {
+			return first, nil, useAddr, err
+		}
+		return first, *list, useAddr, err
+	}
+
+	fn := MakeListingContext(params)
+	fn.types = types
+	fn.isolated = isolated
+	fn.reserve(first.slots)
+	list, useAddr, err = CompileListing(lang, fn, root, nil)
+	if err != nil {
+		return fn, nil, false, err
+	}
+
+	//a run that does not reach any leave must still report its slots, so
+	//every flag starts cleared and falling off the end leaves with them
+	body := []opcodes.Opcode{}
+	for _, slot := range fn.reserved {
+		body = append(body, opcodes.MakeIConst(slot.flag, 0), opcodes.MakeIConst(slot.value, 0))
+	}
+	body = append(body, *list...)
+	if isolated {
+		zero := fn.nextLocal
+		body = append(body, opcodes.MakeIConst(zero, 0), fn.leave(zero))
+	} else {
+		body = append(body, fn.leave())
+	}
+	return fn, body, useAddr, nil
+}
+
+func CompileListing(lang *Language, fn *ListingContext, root parser.CSTNode, listing *[]opcodes.Opcode) (*[]opcodes.Opcode, bool, error) {
 	if listing == nil {
 		listing = &[]opcodes.Opcode{}
 	}
 
 	useAddr := false
-	nextLocal := uint16(len(params))
+
+	//variables declared in the block are not visible outside of it
+	fn.openScope()
+	defer fn.closeScope()
 
 	for _, node := range root.Children() {
 		switch node.ID() {
 		case STMT_BRANCH:
 			{
 				children := node.Children()
-				status := expr.MakeConverter(children[0].Symbols(), nextLocal)
+				status := expr.MakeConverter(children[0].Symbols(), fn.nextLocal)
 
-				err := CompileExpression(lang, params, listing, &status)
+				err := CompileExpression(lang, fn, listing, &status)
 				if err != nil {
-					return nil, false, err
+					return nil, false, errorIn(errorAt(err, firstSymbol(children[0])), ".if condition")
 				}
 
 				useAddr = useAddr || status.HasFlag(USE_THIS_ADDR)
+				condAtom := status.Pop()
+				cond := condAtom.Local()
+				fn.nextLocal = status.LabelLocal()
+
+				//both branches are compiled to report their errors, a known condition keeps only the one taken
+				known := optimizeBodies && isKnown(condAtom)
+				if known {
+					fn.dropKnown(listing, condAtom)
+				}
 
-				taken, tUseAddr, bodyErr := CompileListing(lang, params, children[1], nil)
+				taken, tUseAddr, bodyErr := CompileListing(lang, fn, children[1], nil)
 				if bodyErr != nil {
 					return nil, false, bodyErr
 				}
@@ -225,95 +518,187 @@ func CompileListing(lang *Language, params []string, root parser.CSTNode, listin
 
 				takenLen := len(*taken)
 
+				notTaken := &[]opcodes.Opcode{}
 				if len(children) > 2 {
-					notTaken, fUseAddr, elseErr := CompileListing(lang, params, children[2], nil)
+					var fUseAddr bool
+					var elseErr error
+					notTaken, fUseAddr, elseErr = CompileListing(lang, fn, children[2], nil)
 					if elseErr != nil {
 						return nil, false, elseErr
 					}
 
 					useAddr = useAddr || fUseAddr
+				}
 
-					notTakenLen := len(*notTaken)
+				notTakenLen := len(*notTaken)
 
-					brElse := opcodes.MakeBranch(0, status.Pop().Local(), int32(takenLen)+1)
+				if known && condAtom.Value() != 0 {
+					*listing = append(*listing, *taken...)
+				} else if known {
+					*listing = append(*listing, *notTaken...)
+				} else if len(children) > 2 {
+					brElse := opcodes.MakeBranch(0, cond, int32(takenLen)+1)
 					*listing = append(*listing, brElse)
 					*listing = append(*listing, *taken...)
 					brExit := opcodes.MakeGoto(int32(notTakenLen))
 					*listing = append(*listing, brExit)
 					*listing = append(*listing, *notTaken...)
 				} else {
-					brExit := opcodes.MakeBranch(0, status.Pop().Local(), int32(takenLen))
+					brExit := opcodes.MakeBranch(0, cond, int32(takenLen))
 					*listing = append(*listing, brExit)
 					*listing = append(*listing, *taken...)
 				}
-				nextLocal = status.LabelLocal()
 			}
 		case STMT_ERROR:
 			{
 				syms := node.Symbols()
-				status := expr.MakeConverter(syms[1:2], nextLocal)
-				err := CompileExpression(lang, params, listing, &status)
+				status := expr.MakeConverter(syms[1:2], fn.nextLocal)
+				err := CompileExpression(lang, fn, listing, &status)
 				if err != nil {
-					return listing, false, errors.New("In .error statement:\n" + err.Error())
+					return listing, false, errorIn(errorAt(err, syms[0]), ".error statement")
 				}
 				msg := strings.Trim(syms[3].Value(), "\"")
-				*listing = append(*listing, opcodes.MakeSigError(msg+", value ", status.Pop().Local()))
-				nextLocal = status.LabelLocal()
+				signal := fn.addSignal(lang, msg, syms[1], true)
+				*listing = append(*listing, opcodes.MakeSigError(signal.vmText(), status.Pop().Local()))
+				fn.nextLocal = status.LabelLocal()
 			}
 		case STMT_RET:
 			{
-				status := expr.MakeConverter(node.Children()[0].Symbols(), nextLocal)
-				err := CompileExpression(lang, params, listing, &status)
+				status := expr.MakeConverter(node.Children()[0].Symbols(), fn.nextLocal)
+				err := CompileExpression(lang, fn, listing, &status)
 				if err != nil {
-					return listing, false, err
+					return listing, false, errorIn(errorAt(err, firstSymbol(node)), ".return statement")
 				}
 				useAddr = useAddr || status.HasFlag(USE_THIS_ADDR)
-				*listing = append(*listing, opcodes.MakeLeave(status.Pop().Local()))
-				nextLocal = status.LabelLocal()
+				*listing = append(*listing, fn.leave(status.Pop().Local()))
+				fn.nextLocal = status.LabelLocal()
 			}
 		case STMT_OUT:
 			{
+				if fn.isolated {
+					return listing, false, semanticError(firstSymbol(node), "An inline cannot end with .out, use .emit and .return")
+				}
+				//.out [ a, b ] is .emit a; .emit b; and the end of the body: the items are
+				//returned by the leave, after the values already emitted, unless an item
+				//calls an inline that emits, whose values must come before the item
+				emitItems := callsEmittingInline(lang, node)
 				refs := []uint16{}
 				for _, item := range node.Children() {
-					itemStatus := expr.MakeConverter(item.Symbols(), nextLocal)
-					err := CompileExpression(lang, params, listing, &itemStatus)
+					parts, itemUseAddr, err := CompileOutItem(lang, fn, item, listing)
 					if err != nil {
-						return listing, false, errors.New("In .out statement:\n" + err.Error())
+						return listing, false, errorIn(errorAt(err, firstSymbol(item)), ".out statement")
+					}
+					useAddr = useAddr || itemUseAddr
+					if emitItems {
+						for _, local := range parts {
+							fn.emit(listing, local)
+						}
+					} else {
+						refs = append(refs, parts...)
 					}
-					useAddr = useAddr || itemStatus.HasFlag(USE_THIS_ADDR)
-					refs = append(refs, itemStatus.Pop().Local())
-					nextLocal = itemStatus.LabelLocal()
 				}
-				*listing = append(*listing, opcodes.MakeLeave(refs...))
+				*listing = append(*listing, fn.leave(refs...))
 			}
 		case STMT_OUTR:
 			{
-				refs := make([]uint16, len(node.Children()))
-				index := len(node.Children()) - 1
+				if fn.isolated {
+					return listing, false, semanticError(firstSymbol(node), "An inline cannot end with .outr, use .emit and .return")
+				}
+				if callsEmittingInline(lang, node) {
+					return listing, false, errorIn(semanticError(firstSymbol(node), "the items cannot call an inline that emits, use .out"), ".outr statement")
+				}
+				//the items are reversed, the bytes of a sized item keep their order
+				items := [][]uint16{}
 				for _, item := range node.Children() {
-					itemStatus := expr.MakeConverter(item.Symbols(), nextLocal)
-					err := CompileExpression(lang, params, listing, &itemStatus)
+					parts, itemUseAddr, err := CompileOutItem(lang, fn, item, listing)
 					if err != nil {
-						return listing, false, errors.New("In .outr statement:\n" + err.Error())
+						return listing, false, errorIn(errorAt(err, firstSymbol(item)), ".outr statement")
 					}
-					useAddr = useAddr || itemStatus.HasFlag(USE_THIS_ADDR)
-					refs[index] = itemStatus.Pop().Local()
-					index--
-					nextLocal = itemStatus.LabelLocal()
+					useAddr = useAddr || itemUseAddr
+					items = append(items, parts)
+				}
+				refs := []uint16{}
+				for i := len(items) - 1; i >= 0; i-- {
+					refs = append(refs, items[i]...)
+				}
+				*listing = append(*listing, fn.leave(refs...))
+			}
+		case STMT_LET, STMT_ASSIGN:
+			{
+				name := node.Symbols()[0]
+				status := expr.MakeConverter(node.Children()[0].Symbols(), fn.nextLocal)
+				err := CompileExpression(lang, fn, listing, &status)
+				if err != nil {
+					return listing, false, errorIn(errorAt(err, name), "assignment of "+name.Value())
+				}
+				useAddr = useAddr || status.HasFlag(USE_THIS_ADDR)
+				value := status.Pop().Local()
+
+				//the variable always has its own local: the value may be a parameter
+				//or another variable, and a later assignment must not change them
+				var dest uint16
+				if node.ID() == STMT_LET {
+					dest = status.LabelLocal()
+					err = fn.declare(name.Value(), dest)
+				} else {
+					dest, err = fn.variable(name.Value())
+				}
+				if err != nil {
+					return listing, false, errorAt(err, name)
+				}
+				*listing = append(*listing, MakeCopy(dest, value))
+				fn.nextLocal = status.LabelLocal()
+			}
+		case STMT_FOR, STMT_WHILE:
+			{
+				var loopUseAddr bool
+				var err error
+				if node.ID() == STMT_FOR {
+					loopUseAddr, err = CompileFor(lang, fn, node, listing)
+				} else {
+					loopUseAddr, err = CompileWhile(lang, fn, node, listing)
+				}
+				if err != nil {
+					return listing, false, errorAt(err, firstSymbol(node))
+				}
+				useAddr = useAddr || loopUseAddr
+			}
+		case STMT_EMIT:
+			{
+				//the value is appended to the output only if the statement is executed:
+				//the host reads the flag of the slot after the run
+				parts, emitUseAddr, err := CompileOutItem(lang, fn, node.Children()[0], listing)
+				if err != nil {
+					return listing, false, errorIn(errorAt(err, firstSymbol(node)), ".emit statement")
+				}
+				useAddr = useAddr || emitUseAddr
+				for _, local := range parts {
+					fn.emit(listing, local)
 				}
-				*listing = append(*listing, opcodes.MakeLeave(refs...))
+			}
+		case STMT_BITS:
+			{
+				bitsUseAddr, err := CompileBits(lang, fn, node, listing)
+				if err != nil {
+					return listing, false, errorIn(errorAt(err, firstSymbol(node)), ".bits statement")
+				}
+				useAddr = useAddr || bitsUseAddr
 			}
 		case STMT_WARNING:
 			{
+				//the warning is not raised by the VM: it sets its slot and the
+				//host decides, after the last pass, whether to report it
 				syms := node.Symbols()
-				status := expr.MakeConverter(syms[1:2], nextLocal)
-				err := CompileExpression(lang, params, listing, &status)
+				status := expr.MakeConverter(syms[1:2], fn.nextLocal)
+				err := CompileExpression(lang, fn, listing, &status)
 				if err != nil {
-					return listing, false, errors.New("In .warning statement:\n" + err.Error())
+					return listing, false, errorIn(errorAt(err, syms[0]), ".warning statement")
 				}
 				msg := strings.Trim(syms[3].Value(), "\"")
-				*listing = append(*listing, opcodes.MakeSigWarning(msg+", value ", status.Pop().Local()))
-				nextLocal = status.LabelLocal()
+				slot := fn.takeSlot(fn.addSignal(lang, msg, syms[1], false), "")
+				*listing = append(*listing, opcodes.MakeIConst(slot.flag, 1))
+				*listing = append(*listing, MakeCopy(slot.value, status.Pop().Local()))
+				fn.nextLocal = status.LabelLocal()
 			}
 		}
 	}
@@ -321,6 +706,31 @@ func CompileListing(lang *Language, params []string, root parser.CSTNode, listin
 	return listing, useAddr, nil
 }
 
+// callsEmittingInline is true if an expression inside node calls an inline that emits values
+func callsEmittingInline(lang *Language, node parser.CSTNode) bool {
+	for _, item := range node.Children() {
+		if item.ID() == OUT_ITEM {
+			item = item.Children()[0]
+		}
+		syms := item.Symbols()
+		for i := 0; i+1 < len(syms); i++ {
+			if syms[i].ID() != text.KeywordExpr {
+				continue
+			}
+			addr, found := lang.FindAddressOf(syms[i+1].Value())
+			if !found {
+				continue
+			}
+			for _, slot := range lang.fnSlots[addr] {
+				if slot.emit {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
 // CST Tags
 const (
 	EXPRESSION   = 0
@@ -344,4 +754,18 @@ const (
 	URY_OPERATOR = 18
 	ROOT_NODE    = 19
 	STMT_OUTR    = 20
+	STMT_LET     = 21
+	STMT_ASSIGN  = 22
+	STMT_FOR     = 23
+	STMT_WHILE   = 24
+	STMT_EMIT    = 25
+	STMT_BITS    = 26
+	BIT_FIELD    = 27
+	ATOM_NODE    = 28
+	OUT_ITEM     = 29
+	ENDIAN_NODE  = 30
+	CASE_NODE    = 31
+	CONST_NODE   = 32
+	TABLE_NODE   = 33
+	INCLUDE_NODE = 34
 )
@@ -0,0 +1,71 @@
+package casm
+
+import (
+	"strconv"
+
+	"github.com/aleferri/casmeleon/pkg/parser"
+)
+
+// Layout of the values emitted by the opcodes: the width of the atom and the byte order of the values wider than an atom
+type Layout struct {
+	ByteSize  uint32
+	BigEndian bool
+}
+
+// DeclaredLayout of a language file, the declarations of the file replace the values of defaults
+func DeclaredLayout(root parser.CSTNode, defaults Layout) (Layout, error) {
+	layout := defaults
+	atom, err := DeclaredAtom(root)
+	if err != nil {
+		return layout, err
+	}
+	if atom != 0 {
+		layout.ByteSize = atom
+	}
+	bigEndian, declared, err := DeclaredEndian(root)
+	if err != nil {
+		return layout, err
+	}
+	if declared {
+		layout.BigEndian = bigEndian
+	}
+	return layout, nil
+}
+
+// DeclaredAtom is the width of the atom declared with .atom or .byte, 0 if the language does not declare it
+func DeclaredAtom(root parser.CSTNode) (uint32, error) {
+	atom := uint32(0)
+	for _, k := range root.Children() {
+		if k.ID() != ATOM_NODE {
+			continue
+		}
+		syms := k.Symbols()
+		width, err := strconv.ParseUint(syms[1].Value(), 10, 32)
+		if err != nil || (width != 8 && width != 16 && width != 32) {
+			return 0, semanticErrorf(syms[1], "The %s must be 8, 16 or 32 bits wide, found %s", syms[0].Value(), syms[1].Value())
+		}
+		if atom != 0 && atom != uint32(width) {
+			return 0, semanticErrorf(syms[1], "The width of the atom is declared twice, as %d and as %d bits", atom, width)
+		}
+		atom = uint32(width)
+	}
+	return atom, nil
+}
+
+// DeclaredEndian is the byte order declared with .endian, declared is false if the language does not declare it
+func DeclaredEndian(root parser.CSTNode) (bigEndian bool, declared bool, err error) {
+	for _, k := range root.Children() {
+		if k.ID() != ENDIAN_NODE {
+			continue
+		}
+		order := k.Symbols()[1].Value()
+		if order != "big" && order != "little" {
+			return false, false, semanticError(k.Symbols()[1], "The .endian must be big or little, found "+order)
+		}
+		if declared && bigEndian != (order == "big") {
+			return false, false, semanticError(k.Symbols()[1], "The .endian is declared twice, as big and as little")
+		}
+		bigEndian, declared = order == "big", true
+	}
+	return bigEndian, declared, nil
+}
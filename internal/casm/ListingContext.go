@@ -0,0 +1,236 @@
+package casm
+
+import (
+	"errors"
+	"math"
+
+	"github.com/aleferri/casmeleon/pkg/text"
+	"github.com/aleferri/casmvm/pkg/opcodes"
+	"github.com/aleferri/casmvm/pkg/operators"
+)
+
+// Slot is a pair of locals that a body returns after its outputs: a flag, not zero if the statement that
+// owns the slot was executed, and the value it reported. Every .warning and every .emit, in the body or in
+// the inlines it calls, owns one slot, so the host knows which warnings a run raised without the VM printing
+// them and which values were emitted, in order, before the final .out.
+type Slot struct {
+	flag   uint16
+	value  uint16
+	signal Signal
+	origin string //inline that owns the statement, empty if it is in the body itself
+	emit   bool   //owned by an .emit, the value is part of the output
+}
+
+// IsEmit is true if the slot is owned by an .emit statement
+func (s Slot) IsEmit() bool {
+	return s.emit
+}
+
+// Signal is the .warning statement that owns the slot
+func (s Slot) Signal() Signal {
+	return s.signal
+}
+
+// Origin is the inline that contains the statement, empty if it is in the opcode body
+func (s Slot) Origin() string {
+	return s.origin
+}
+
+// ListingContext is the state of the compilation of the body of an opcode or of an inline
+type ListingContext struct {
+	params    []string
+	types     []uint32 //set of every parameter, to check the arguments of the inlines
+	signals   []Signal
+	nextLocal uint16
+	slots     []Slot
+	reserved  []Slot                //slots found by the previous compilation of the same body
+	scopes    []map[string]variable //variables, one map per open block
+	dynamic   bool                  //the last expression compiled reads a parameter or a variable
+	isolated  bool                  //body of an inline, that returns a value instead of the output
+	copies    int64                 //copies of the innermost loop being unrolled, counted across the enclosing loops
+	knownAt   map[uint16]int        //position in the listing of the constant of every known value
+}
+
+// variable declared with .let or by a loop
+type variable struct {
+	local    uint16
+	readOnly bool  //loop counters
+	known    bool  //the value is known at compile time, as the counter of an unrolled loop
+	value    int64 //value if known
+}
+
+// checkLocals after the code of a copy of a loop: the locals are numbered with 16 bits, so a body with too
+// many copies wraps around and reuses the locals of the first ones. Before is the first local of the copy
+func (ctx *ListingContext) checkLocals(before uint16, at text.Symbol) error {
+	if ctx.nextLocal < before {
+		return semanticErrorf(at, "The loop needs more than %d locals once unrolled, lower its .limit or the .limit of the loops inside it", math.MaxUint16)
+	}
+	return nil
+}
+
+// enterLoop of n copies: the copies multiply with the ones of the enclosing loops and the total is limited
+// to maxUnrolled. The result is the count of the enclosing loops, to restore once the loop is compiled
+func (ctx *ListingContext) enterLoop(n int64, at text.Symbol) (int64, error) {
+	outer := ctx.copies
+	total := n
+	if total < 0 {
+		total = 0
+	}
+	if outer > 0 {
+		total *= outer
+	}
+	if total > maxUnrolled {
+		return outer, semanticErrorf(at, "The loop is copied %d times once unrolled together with the loops around it, the maximum is %d", total, maxUnrolled)
+	}
+	ctx.copies = total
+	return outer, nil
+}
+
+// MakeListingContext for a body with the specified parameters
+func MakeListingContext(params []string) *ListingContext {
+	return &ListingContext{params: params, signals: []Signal{}, nextLocal: uint16(len(params)), slots: []Slot{}, reserved: []Slot{}, knownAt: map[uint16]int{}}
+}
+
+func (ctx *ListingContext) openScope() {
+	ctx.scopes = append(ctx.scopes, map[string]variable{})
+}
+
+func (ctx *ListingContext) closeScope() {
+	ctx.scopes = ctx.scopes[:len(ctx.scopes)-1]
+}
+
+// lookup a variable, from the innermost block to the outermost
+func (ctx *ListingContext) lookup(name string) (variable, bool) {
+	for i := len(ctx.scopes) - 1; i >= 0; i-- {
+		if v, found := ctx.scopes[i][name]; found {
+			return v, true
+		}
+	}
+	return variable{}, false
+}
+
+// declare a variable in the innermost block, a variable can hide the variables of the outer blocks but not a parameter
+func (ctx *ListingContext) declare(name string, local uint16) error {
+	return ctx.bind(name, variable{local: local})
+}
+
+func (ctx *ListingContext) bind(name string, v variable) error {
+	for _, p := range ctx.params {
+		if p == name {
+			return errors.New("Variable " + name + " hides the parameter with the same name")
+		}
+	}
+	scope := ctx.scopes[len(ctx.scopes)-1]
+	if _, found := scope[name]; found {
+		return errors.New("Variable " + name + " is already declared in the same block")
+	}
+	scope[name] = v
+	return nil
+}
+
+// variable to assign, parameters are read only
+func (ctx *ListingContext) variable(name string) (uint16, error) {
+	v, found := ctx.lookup(name)
+	if found && v.readOnly {
+		return 0, errors.New("Loop variable " + name + " cannot be assigned")
+	}
+	if found {
+		return v.local, nil
+	}
+	for _, p := range ctx.params {
+		if p == name {
+			return 0, errors.New("Parameter " + name + " cannot be assigned, declare a variable with .let")
+		}
+	}
+	return 0, errors.New("Variable " + name + " not declared, use .let " + name + " = ...")
+}
+
+// reserve the slots found by a previous compilation: they take the locals right after the parameters,
+// so every leave of the body can return them, even those compiled before the statement that owns them
+func (ctx *ListingContext) reserve(found []Slot) {
+	for _, s := range found {
+		s.flag = ctx.nextLocal
+		s.value = ctx.nextLocal + 1
+		ctx.nextLocal += 2
+		ctx.reserved = append(ctx.reserved, s)
+	}
+}
+
+// addSignal record an .error or a .warning of the body, numbered in the language
+func (ctx *ListingContext) addSignal(lang *Language, msg string, symbol text.Symbol, fatal bool) Signal {
+	param := -1
+	for i, p := range ctx.params {
+		if p == symbol.Value() {
+			param = i
+			break
+		}
+	}
+	signal := Signal{message: msg, symbol: symbol, param: param, fatal: fatal, id: lang.signalCount}
+	lang.signalCount++
+	ctx.signals = append(ctx.signals, signal)
+	return signal
+}
+
+// takeSlot for the next statement that need one, in order of compilation
+func (ctx *ListingContext) takeSlot(signal Signal, origin string) Slot {
+	slot := Slot{signal: signal, origin: origin}
+	n := len(ctx.slots)
+	if n < len(ctx.reserved) {
+		slot.flag, slot.value = ctx.reserved[n].flag, ctx.reserved[n].value
+	} else {
+		//first compilation: the locals are placeholders, the listing is thrown away
+		slot.flag, slot.value = ctx.nextLocal, ctx.nextLocal+1
+		ctx.nextLocal += 2
+	}
+	ctx.slots = append(ctx.slots, slot)
+	return slot
+}
+
+// takeEmit slot for the next .emit statement
+func (ctx *ListingContext) takeEmit(origin string) Slot {
+	slot := ctx.takeSlot(Signal{param: -1}, origin)
+	slot.emit = true
+	ctx.slots[len(ctx.slots)-1] = slot
+	return slot
+}
+
+// emit the value of local: the flag of a new emit slot is set and the value copied into it
+func (ctx *ListingContext) emit(listing *[]opcodes.Opcode, local uint16) {
+	slot := ctx.takeEmit("")
+	*listing = append(*listing, opcodes.MakeIConst(slot.flag, 1), MakeCopy(slot.value, local))
+}
+
+// constant in a new local
+func (ctx *ListingContext) constant(listing *[]opcodes.Opcode, v int64) uint16 {
+	local := ctx.nextLocal
+	ctx.nextLocal++
+	*listing = append(*listing, opcodes.MakeIConst(local, v))
+	return local
+}
+
+// binary operation between two locals, the result is in a new local
+func (ctx *ListingContext) binary(listing *[]opcodes.Opcode, op string, a uint16, b uint16) uint16 {
+	local := ctx.nextLocal
+	ctx.nextLocal++
+	*listing = append(*listing, opcodes.MakeBinaryOp(local, op, opcodes.IntShape, a, b, operators.BinaryOperatorsSymbols[op]))
+	return local
+}
+
+// slotLocals to append to the locals returned by a leave
+func (ctx *ListingContext) slotLocals() []uint16 {
+	refs := []uint16{}
+	for _, s := range ctx.reserved {
+		refs = append(refs, s.flag, s.value)
+	}
+	return refs
+}
+
+// leave the function returning refs followed by the slots
+func (ctx *ListingContext) leave(refs ...uint16) opcodes.Opcode {
+	return opcodes.MakeLeave(append(refs, ctx.slotLocals()...)...)
+}
+
+// MakeCopy of a local into another local
+func MakeCopy(dest uint16, src uint16) opcodes.Opcode {
+	return opcodes.MakeBinaryOp(dest, "|", opcodes.IntShape, src, src, operators.BinaryOperatorsSymbols["|"])
+}
@@ -0,0 +1,261 @@
+package casm
+
+import (
+	"fmt"
+
+	"github.com/aleferri/casmeleon/pkg/expr"
+	"github.com/aleferri/casmeleon/pkg/parser"
+	"github.com/aleferri/casmvm/pkg/opcodes"
+	"github.com/aleferri/casmvm/pkg/operators"
+	"github.com/aleferri/casmvm/pkg/vmex"
+	"github.com/aleferri/casmvm/pkg/vmio"
+)
+
+// maxUnrolled is the maximum number of copies of the body of a loop, nested loops included: the inner body
+// is copied once for every copy of the outer ones. Loops are unrolled because the VM returns a fixed list
+// of locals: every copy owns its .emit and .warning slots.
+const maxUnrolled = 1024
+
+// loopCopy is one iteration of an unrolled loop: the code that evaluates the condition, the local of the
+// condition and the body, that is skipped together with all the following copies if the condition is false
+type loopCopy struct {
+	head []opcodes.Opcode
+	cond uint16
+	body []opcodes.Opcode
+}
+
+// evaluate a listing that does not read parameters, the result is the value of the local result
+func (lang *Language) evaluate(listing []opcodes.Opcode, result uint16) (int64, error) {
+	list := append(append([]opcodes.Opcode{}, listing...), opcodes.MakeLeave(result))
+	fns := append(append([]vmex.Callable{}, lang.fnList...), vmex.MakeCallable(".const", []string{}, list))
+	m := vmex.MakeInterpreter(fns, vmio.MakeVMLoggerConsole(vmio.ALL), vmex.MakeVMFrame())
+	frame := vmex.MakeVMFrame()
+	err := m.Start(int32(len(fns)-1), &frame)
+	if err != nil {
+		return 0, err
+	}
+	return frame.Returns().Peek(0), nil
+}
+
+// constantOf an expression, known is false if the expression reads a parameter, a variable or calls an inline
+func constantOf(lang *Language, fn *ListingContext, node parser.CSTNode) (v int64, known bool, err error) {
+	status := expr.MakeConverter(node.Symbols(), fn.nextLocal)
+	listing := []opcodes.Opcode{}
+	fn.dynamic = false
+	err = CompileExpression(lang, fn, &listing, &status)
+	if err != nil || fn.dynamic {
+		return 0, false, err
+	}
+	v, err = lang.evaluate(listing, status.Pop().Local())
+	return v, err == nil, err
+}
+
+// limitOf a loop, it must be known at compile time
+func limitOf(lang *Language, fn *ListingContext, node parser.CSTNode) (int64, error) {
+	limit, known, err := constantOf(lang, fn, node)
+	if err != nil {
+		return 0, errorAt(err, firstSymbol(node))
+	}
+	if !known {
+		return 0, semanticError(firstSymbol(node), "The .limit of a loop must be known at compile time")
+	}
+	if limit < 0 || limit > maxUnrolled {
+		return 0, semanticErrorf(firstSymbol(node), "The .limit of a loop must be between 0 and %d, found %d", maxUnrolled, limit)
+	}
+	return limit, nil
+}
+
+// compileExpressionNode compile an expression into listing, returning the local of its value
+func compileExpressionNode(lang *Language, fn *ListingContext, node parser.CSTNode, listing *[]opcodes.Opcode) (uint16, bool, error) {
+	status := expr.MakeConverter(node.Symbols(), fn.nextLocal)
+	err := CompileExpression(lang, fn, listing, &status)
+	if err != nil {
+		return 0, false, err
+	}
+	local := status.Pop().Local()
+	fn.nextLocal = status.LabelLocal()
+	return local, status.HasFlag(USE_THIS_ADDR), nil
+}
+
+// CompileFor compile a .for over a range. If the bounds are known at compile time the body is copied once
+// for every value of the counter, that is a constant in each copy; otherwise the loop needs a .limit and
+// the body is copied limit times, every copy guarded by the test of the counter against the upper bound.
+func CompileFor(lang *Language, fn *ListingContext, node parser.CSTNode, listing *[]opcodes.Opcode) (bool, error) {
+	nameSym := node.Symbols()[0]
+	name := nameSym.Value()
+	children := node.Children()
+
+	from, fromKnown, err := constantOf(lang, fn, children[0])
+	if err != nil {
+		return false, errorIn(errorAt(err, firstSymbol(children[0])), "the range of .for "+name)
+	}
+	to, toKnown, err := constantOf(lang, fn, children[1])
+	if err != nil {
+		return false, errorIn(errorAt(err, firstSymbol(children[1])), "the range of .for "+name)
+	}
+
+	if fromKnown && toKnown {
+		if to-from > maxUnrolled {
+			return false, semanticErrorf(nameSym, "The range of .for %s has %d values, the maximum is %d", name, to-from, maxUnrolled)
+		}
+		outer, err := fn.enterLoop(to-from, nameSym)
+		if err != nil {
+			return false, err
+		}
+		defer func() { fn.copies = outer }()
+		useAddr := false
+		for k := from; k < to; k++ {
+			before := fn.nextLocal
+			fn.openScope()
+			bodyErr := fn.bind(name, variable{readOnly: true, known: true, value: k})
+			bodyUseAddr := false
+			if bodyErr == nil {
+				_, bodyUseAddr, bodyErr = CompileListing(lang, fn, children[2], listing)
+			}
+			fn.closeScope()
+			if bodyErr == nil {
+				bodyErr = fn.checkLocals(before, nameSym)
+			}
+			if bodyErr != nil {
+				return false, bodyErr
+			}
+			useAddr = useAddr || bodyUseAddr
+		}
+		return useAddr, nil
+	}
+
+	if len(children) < 4 {
+		return false, semanticError(nameSym, "The range of .for "+name+" is not known at compile time, add a .limit")
+	}
+	limit, err := limitOf(lang, fn, children[3])
+	if err != nil {
+		return false, err
+	}
+	outer, err := fn.enterLoop(limit, nameSym)
+	if err != nil {
+		return false, err
+	}
+	defer func() { fn.copies = outer }()
+
+	//the counter and the upper bound get their own locals, the body cannot change them
+	fromLocal, fromUseAddr, err := compileExpressionNode(lang, fn, children[0], listing)
+	if err != nil {
+		return false, err
+	}
+	toLocal, toUseAddr, err := compileExpressionNode(lang, fn, children[1], listing)
+	if err != nil {
+		return false, err
+	}
+	counter, bound, one := fn.nextLocal, fn.nextLocal+1, fn.nextLocal+2
+	fn.nextLocal += 3
+	*listing = append(*listing, MakeCopy(counter, fromLocal), MakeCopy(bound, toLocal), opcodes.MakeIConst(one, 1))
+
+	useAddr := fromUseAddr || toUseAddr
+	test := func(head *[]opcodes.Opcode) uint16 {
+		cond := fn.nextLocal
+		fn.nextLocal++
+		*head = append(*head, opcodes.MakeBinaryOp(cond, "<", opcodes.IntShape, counter, bound, operators.BinaryOperatorsSymbols["<"]))
+		return cond
+	}
+
+	copies := []loopCopy{}
+	for k := int64(0); k < limit; k++ {
+		before := fn.nextLocal
+		c := loopCopy{}
+		c.cond = test(&c.head)
+		fn.openScope()
+		bodyErr := fn.bind(name, variable{local: counter, readOnly: true})
+		bodyUseAddr := false
+		if bodyErr == nil {
+			_, bodyUseAddr, bodyErr = CompileListing(lang, fn, children[2], &c.body)
+		}
+		fn.closeScope()
+		if bodyErr == nil {
+			bodyErr = fn.checkLocals(before, nameSym)
+		}
+		if bodyErr != nil {
+			return false, bodyErr
+		}
+		useAddr = useAddr || bodyUseAddr
+		c.body = append(c.body, opcodes.MakeBinaryOp(counter, "+", opcodes.IntShape, counter, one, operators.BinaryOperatorsSymbols["+"]))
+		copies = append(copies, c)
+	}
+
+	guard := loopCopy{}
+	guard.cond = test(&guard.head)
+	msg := fmt.Sprintf(".for %s exceeded its limit of %d iterations, value ", name, limit)
+	guard.body = []opcodes.Opcode{opcodes.MakeSigError(msg, counter)}
+	appendUnrolled(listing, copies, guard)
+	return useAddr, nil
+}
+
+// CompileWhile compile a .while, the body is copied limit times, every copy guarded by the condition
+func CompileWhile(lang *Language, fn *ListingContext, node parser.CSTNode, listing *[]opcodes.Opcode) (bool, error) {
+	children := node.Children()
+	limit, err := limitOf(lang, fn, children[2])
+	if err != nil {
+		return false, err
+	}
+	outer, err := fn.enterLoop(limit, firstSymbol(node))
+	if err != nil {
+		return false, err
+	}
+	defer func() { fn.copies = outer }()
+
+	useAddr := false
+	test := func(head *[]opcodes.Opcode) (uint16, error) {
+		cond, condUseAddr, condErr := compileExpressionNode(lang, fn, children[0], head)
+		useAddr = useAddr || condUseAddr
+		return cond, condErr
+	}
+
+	copies := []loopCopy{}
+	for k := int64(0); k < limit; k++ {
+		before := fn.nextLocal
+		c := loopCopy{}
+		c.cond, err = test(&c.head)
+		if err != nil {
+			return false, errorIn(errorAt(err, firstSymbol(children[0])), ".while condition")
+		}
+		_, bodyUseAddr, bodyErr := CompileListing(lang, fn, children[1], &c.body)
+		if bodyErr == nil {
+			bodyErr = fn.checkLocals(before, firstSymbol(node))
+		}
+		if bodyErr != nil {
+			return false, bodyErr
+		}
+		useAddr = useAddr || bodyUseAddr
+		copies = append(copies, c)
+	}
+
+	guard := loopCopy{}
+	guard.cond, err = test(&guard.head)
+	if err != nil {
+		return false, errorIn(errorAt(err, firstSymbol(children[0])), ".while condition")
+	}
+	msg := fmt.Sprintf(".while exceeded its limit of %d iterations, condition ", limit)
+	guard.body = []opcodes.Opcode{opcodes.MakeSigError(msg, guard.cond)}
+	appendUnrolled(listing, copies, guard)
+	return useAddr, nil
+}
+
+// appendUnrolled copies to the listing: a false condition jumps past all the following copies and the guard,
+// the guard raises the error if the condition is still true after the last copy
+func appendUnrolled(listing *[]opcodes.Opcode, copies []loopCopy, guard loopCopy) {
+	//length of the code after the branch of every copy, up to the end of the loop
+	after := make([]int, len(copies))
+	rest := len(guard.head) + 1 + len(guard.body)
+	for k := len(copies) - 1; k >= 0; k-- {
+		after[k] = len(copies[k].body) + rest
+		rest += len(copies[k].head) + 1 + len(copies[k].body)
+	}
+
+	for k, c := range copies {
+		*listing = append(*listing, c.head...)
+		*listing = append(*listing, opcodes.MakeBranch(0, c.cond, int32(after[k])))
+		*listing = append(*listing, c.body...)
+	}
+	*listing = append(*listing, guard.head...)
+	*listing = append(*listing, opcodes.MakeBranch(0, guard.cond, int32(len(guard.body))))
+	*listing = append(*listing, guard.body...)
+}
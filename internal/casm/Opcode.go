@@ -1,7 +1,8 @@
 package casm
 
 import (
-	"errors"
+	"sort"
+	"strings"
 
 	"github.com/aleferri/casmeleon/pkg/parser"
 	"github.com/aleferri/casmeleon/pkg/text"
@@ -11,13 +12,22 @@ import (
 
 // Opcode declared in the assembly language
 type Opcode struct {
-	name    string           //opcode name
-	params  []string         //opcode parameters name
-	format  []uint32         //opcode parameters format
-	types   []uint32         //param types
-	runList []opcodes.Opcode //executable operations
-	frame   int32
-	useAddr bool
+	name       string           //opcode name
+	params     []string         //opcode parameters name
+	format     []uint32         //opcode parameters format
+	paramTypes []uint32         //set of every parameter, in the order of params
+	types      []uint32         //param types
+	typed      []bool           //every identifier of the pattern, false if .with gives it no type and no entry in types
+	sets       []Set            //set of every typed param, to test if an operand is one of its members
+	runList    []opcodes.Opcode //executable operations
+	frame      int32
+	useAddr    bool
+	symbol     text.Symbol //opcode name as found in the .casm file
+	signals    []Signal    //.error and .warning statements of the body
+	slots      []Slot      //warnings and emitted values returned after the outputs, in order
+
+	binding  []int            //operand of the source line of every param, -1 if the param takes its default
+	defaults map[string]int64 //default value of the params that are in optional groups
 }
 
 func (o Opcode) UseAddress() bool {
@@ -32,6 +42,11 @@ func (o Opcode) Format() []uint32 {
 	return o.format
 }
 
+// Symbol of the opcode name in the language file
+func (o Opcode) Symbol() text.Symbol {
+	return o.symbol
+}
+
 func (o Opcode) RunList() []opcodes.Opcode {
 	return o.runList
 }
@@ -40,10 +55,14 @@ func (o Opcode) StringifyFormat(lang *Language) []string {
 	desc := []string{}
 
 	ids := 0
-	for _, particle := range o.format {
+	for k, particle := range o.format {
 		if particle == text.Identifier {
-			desc = append(desc, lang.sets[o.types[ids]].name)
-			ids++
+			if o.isTyped(k) {
+				desc = append(desc, lang.sets[o.types[ids]].name)
+				ids++
+			} else {
+				desc = append(desc, "?")
+			}
 		} else {
 			desc = append(desc, idDescriptor[particle])
 		}
@@ -52,38 +71,174 @@ func (o Opcode) StringifyFormat(lang *Language) []string {
 	return desc
 }
 
-func (o Opcode) InvokeTarget() int32 {
-	return o.frame
+// Signals are the .error and .warning statements in the body of the opcode
+func (o Opcode) Signals() []Signal {
+	return o.signals
 }
 
-func (o Opcode) Accept(format []uint32, types []uint32) bool {
-	if len(format) != len(o.format) {
-		return false
+// Slots returned by every run of the opcode after its outputs, as a flag and a value each
+func (o Opcode) Slots() []Slot {
+	return o.slots
+}
+
+// ParamCount is the number of parameters of the body, without the hidden .addr
+func (o Opcode) ParamCount() int {
+	return len(o.params) - 1
+}
+
+// Operand of the source line bound to the parameter, -1 if the parameter is not in the form matched
+func (o Opcode) Operand(param int) int {
+	if param < 0 || param >= len(o.binding) {
+		return -1
 	}
+	return o.binding[param]
+}
 
+// Default value of a parameter that is not in the form matched
+func (o Opcode) Default(param int) int64 {
+	return o.defaults[o.params[param]]
+}
+
+func (o Opcode) InvokeTarget() int32 {
+	return o.frame
+}
+
+// Accept the format of a source line, operands are the source text of the parameters
+func (o Opcode) Accept(format []uint32, types []uint32, operands []string) bool {
 	//Considering the additional hidden .addr parameter
 	if len(types) != len(o.types)-1 {
 		return false
 	}
 
+	return o.FirstMismatch(format, types, operands) < 0
+}
+
+// acceptOperand of type t as the parameter ids: a symbol that is a member of more than one set,
+// as a register of both a subset and its parent, is accepted by every set that contains it
+func (o Opcode) acceptOperand(ids int, t uint32, operands []string) bool {
+	if o.types[ids] == t {
+		return true
+	}
+	return t > 1 && o.types[ids] > 1 && ids < len(operands) && o.sets[ids].Contains(operands[ids])
+}
+
+// MemberValue of the set member name as the operand of the source line: a register of more than one set
+// takes the value it has in the set of the parameter that accepted it, false if the operand is not a member
+func (o Opcode) MemberValue(operand int, name string) (int64, bool) {
+	if operand < 0 || operand >= len(o.types)-1 || o.types[operand] <= 1 {
+		return 0, false
+	}
+	v, found := o.sets[operand].Value(name)
+	return int64(v), found
+}
+
+// isTyped is true if the particle k of the pattern is an identifier with a type in .with
+func (o Opcode) isTyped(k int) bool {
+	ids := 0
+	for i := 0; i < k; i++ {
+		if o.format[i] == text.Identifier {
+			ids++
+		}
+	}
+	return o.format[k] == text.Identifier && ids < len(o.typed) && o.typed[ids]
+}
+
+// FirstMismatch return the index in format of the first particle not accepted by the opcode pattern,
+// len of the shortest of the two if one is a prefix of the other, -1 if the pattern accept the format
+func (o Opcode) FirstMismatch(format []uint32, types []uint32, operands []string) int {
 	ids := 0
 
 	for i, particle := range o.format {
-		if particle != format[i] {
-			return false
+		if i >= len(format) || particle != format[i] {
+			return i
 		}
 
 		if particle == text.Identifier {
-			if o.types[ids] != types[ids] {
-				return false
+			//an identifier without a type in .with accepts no operand, the ones before it are all typed
+			if !o.isTyped(i) || ids >= len(o.types)-1 || ids >= len(types) || !o.acceptOperand(ids, types[ids], operands) {
+				return i
 			}
 			ids++
 		}
 	}
 
+	if len(format) != len(o.format) {
+		return len(o.format)
+	}
+
+	return -1
+}
+
+// SamePattern is true if every source line accepted by o is also accepted by other
+func (o Opcode) SamePattern(other Opcode) bool {
+	if o.name != other.name || len(o.format) != len(other.format) || len(o.types) != len(other.types) {
+		return false
+	}
+	for i, particle := range o.format {
+		if particle != other.format[i] || o.isTyped(i) != other.isTyped(i) {
+			return false
+		}
+	}
+	for i, t := range o.types {
+		if t != other.types[i] {
+			return false
+		}
+	}
 	return true
 }
 
+// Overlap find the source lines accepted by both o and other: a parameter accepts the members of its set, so
+// two different sets overlap on the members they share, as a subset and its parent. Partial describes the
+// parameters of o whose set is not contained in the set of other, with the members they share, it is empty
+// if every line accepted by o is also accepted by other
+func (o Opcode) Overlap(other Opcode) (partial []string, overlaps bool) {
+	if o.name != other.name || len(o.format) != len(other.format) || len(o.types) != len(other.types) {
+		return nil, false
+	}
+	for i, particle := range o.format {
+		if particle != other.format[i] || o.isTyped(i) != other.isTyped(i) {
+			return nil, false
+		}
+	}
+	partial = []string{}
+	for i, t := range o.types {
+		if t == other.types[i] {
+			continue
+		}
+		if t <= 1 || other.types[i] <= 1 {
+			return nil, false
+		}
+		names := make([]string, 0, len(o.sets[i].members))
+		for n := range o.sets[i].members {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		shared := []string{}
+		for _, n := range names {
+			if other.sets[i].Contains(n) {
+				shared = append(shared, n)
+			}
+		}
+		if len(shared) == 0 {
+			return nil, false
+		}
+		if len(shared) < len(names) {
+			partial = append(partial, o.paramOf(i)+" in "+strings.Join(shared, ", "))
+		}
+	}
+	return partial, true
+}
+
+// paramOf the identifier k of the pattern, .addr if it is not a parameter
+func (o Opcode) paramOf(k int) string {
+	for param, operand := range o.binding {
+		if operand == k {
+			return o.params[param]
+		}
+	}
+	return ".addr"
+}
+
 func StringifyFormat(lang *Language, format []uint32, types []uint32) []string {
 	desc := []string{}
 
@@ -106,43 +261,173 @@ const (
 	LABEL  = 1
 )
 
-// PruneToOpcode remove the header from the opcode CST and return Opcode and Body CST
-func PruneToOpcode(lang *Language, op parser.CSTNode) (Opcode, parser.CSTNode, error) {
+// maxVariants is the maximum number of forms of an opcode with optional groups
+const maxVariants = 64
+
+// PruneToOpcode remove the header from the opcode CST and return the Opcode and the Body CST. A pattern
+// with optional groups gives one Opcode for every combination of the groups, all sharing the same body:
+// the parameters of a group that is not present take their default value
+func PruneToOpcode(lang *Language, op parser.CSTNode) ([]Opcode, parser.CSTNode, error) {
 	toks := op.Symbols()
 	name := toks[1]
 	children := op.Children()
 
 	argsLUT, err := extractTypes(lang, children[1].Children())
 	if err != nil {
-		return Opcode{}, nil, err
+		return nil, nil, err
 	}
 
 	parsedFormat := children[0].Children()
-	argsFormat := []uint32{}
+	pattern := []text.Symbol{}
+	if len(parsedFormat) > 0 {
+		pattern = parsedFormat[0].Symbols()
+	}
 
+	//the parameters are those of the complete pattern, in order
 	params := []string{}
-	types := []uint32{}
+	index := map[string]int{}
+	for _, f := range pattern {
+		if _, ok := argsLUT[f.Value()]; ok && f.ID() == text.Identifier {
+			if _, seen := index[f.Value()]; !seen {
+				index[f.Value()] = len(params)
+				params = append(params, f.Value())
+			}
+		}
+	}
+	params = append(params, ".addr")
+	paramTypes := []uint32{}
+	for _, p := range params[:len(params)-1] {
+		paramTypes = append(paramTypes, argsLUT[p])
+	}
+	paramTypes = append(paramTypes, LABEL)
 
-	if len(parsedFormat) > 0 {
-		for _, f := range parsedFormat[0].Symbols() {
+	variants, err := expandPattern(pattern)
+	if err != nil {
+		return nil, nil, errorIn(err, "the pattern of opcode "+name.Value())
+	}
+	if len(variants) > maxVariants {
+		return nil, nil, semanticErrorf(name, "The pattern of opcode %s has %d forms, the maximum is %d", name.Value(), len(variants), maxVariants)
+	}
+
+	defaults, err := extractDefaults(lang, children[1].Children())
+	if err != nil {
+		return nil, nil, errorIn(err, "opcode "+name.Value())
+	}
+
+	frame := lang.AssignFrame(vmex.MakeCallable("", []string{}, []opcodes.Opcode{}), name.Value())
+	forms := []Opcode{}
+	for _, v := range variants {
+		argsFormat := []uint32{}
+		types := []uint32{}
+		sets := []Set{}
+		binding := make([]int, len(params)-1)
+		for k := range binding {
+			binding[k] = -1
+		}
+
+		typed := []bool{}
+		for _, f := range v {
 			argsFormat = append(argsFormat, f.ID())
 			if f.ID() == text.Identifier {
 				tp, ok := argsLUT[f.Value()]
+				typed = append(typed, ok)
 				if ok {
+					binding[index[f.Value()]] = len(types)
 					types = append(types, tp)
-					params = append(params, f.Value())
+					sets = append(sets, lang.sets[tp])
 				}
 			}
 		}
+		for k, b := range binding {
+			if _, found := defaults[params[k]]; b < 0 && !found {
+				return nil, nil, semanticError(name, "Parameter "+params[k]+" of opcode "+name.Value()+" is optional, give it a default value in .with")
+			}
+		}
+
+		types = append(types, 1)
+		sets = append(sets, lang.sets[1])
+		forms = append(forms, Opcode{
+			name: name.Value(), format: argsFormat, params: params, paramTypes: paramTypes, types: types, typed: typed, sets: sets, frame: frame, symbol: name,
+			binding: binding, defaults: defaults,
+		})
 	}
 
-	params = append(params, ".addr")
-	types = append(types, 1)
+	return forms, children[2], nil
+}
+
+// expandPattern into every combination of its optional groups, .opt [ ... ], the longest first
+func expandPattern(pattern []text.Symbol) ([][]text.Symbol, error) {
+	variants := [][]text.Symbol{{}}
+	for i := 0; i < len(pattern); i++ {
+		f := pattern[i]
+		if f.ID() != text.KeywordOpt {
+			for k := range variants {
+				variants[k] = append(variants[k], f)
+			}
+			continue
+		}
+
+		if i+1 >= len(pattern) || pattern[i+1].ID() != text.SquareOpen {
+			return nil, semanticError(f, ".opt must be followed by [")
+		}
+		//literal brackets can be nested inside the group
+		end, depth := i+2, 1
+		for ; end < len(pattern) && depth > 0; end++ {
+			switch pattern[end].ID() {
+			case text.SquareOpen:
+				depth++
+			case text.SquareClose:
+				depth--
+			}
+		}
+		if depth > 0 {
+			return nil, semanticError(f, "The ] that closes .opt is missing")
+		}
+		inner, err := expandPattern(pattern[i+2 : end-1])
+		if err != nil {
+			return nil, err
+		}
+
+		expanded := [][]text.Symbol{}
+		for _, v := range variants {
+			for _, in := range inner {
+				expanded = append(expanded, append(append([]text.Symbol{}, v...), in...))
+			}
+		}
+		for _, v := range variants {
+			expanded = append(expanded, v)
+		}
+		variants = expanded
+		i = end - 1
+	}
+	return variants, nil
+}
 
-	body := children[2]
-	opcodeName := name.Value()
-	frame := lang.AssignFrame(vmex.MakeCallable("", []string{}, []opcodes.Opcode{}), opcodeName)
-	return Opcode{name: opcodeName, format: argsFormat, params: params, types: types, frame: frame}, body, nil
+// extractDefaults of the parameters: a number or a member of the set of the parameter
+func extractDefaults(lang *Language, args []parser.CSTNode) (map[string]int64, error) {
+	defaults := map[string]int64{}
+	for _, a := range args {
+		tokens := a.Symbols()
+		if len(tokens) < 5 {
+			continue
+		}
+		value := tokens[4]
+		if value.ID() == text.Number || lang.prefixedNumber(value.Value()) {
+			v, err := lang.parseNumber(value.Value())
+			if err != nil {
+				return nil, semanticError(value, "Invalid default value "+value.Value()+" for parameter "+tokens[0].Value())
+			}
+			defaults[tokens[0].Value()] = v
+			continue
+		}
+		set, _ := lang.SetByName(tokens[2].Value())
+		v, found := set.Value(value.Value())
+		if !found || set.ID() <= 1 {
+			return nil, semanticError(value, "The default value "+value.Value()+" of parameter "+tokens[0].Value()+" is not a member of "+tokens[2].Value())
+		}
+		defaults[tokens[0].Value()] = int64(v)
+	}
+	return defaults, nil
 }
 
 func extractTypes(lang *Language, args []parser.CSTNode) (map[string]uint32, error) {
@@ -153,7 +438,7 @@ func extractTypes(lang *Language, args []parser.CSTNode) (map[string]uint32, err
 		setName := tokens[2].Value()
 		set, found := lang.SetByName(setName)
 		if !found {
-			return nil, errors.New("Set " + setName + " do not exists")
+			return nil, semanticError(tokens[2], "Set "+setName+" do not exists")
 		}
 		lut[name] = set.index
 	}
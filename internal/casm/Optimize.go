@@ -0,0 +1,59 @@
+package casm
+
+import (
+	"github.com/aleferri/casmeleon/pkg/expr"
+	"github.com/aleferri/casmvm/pkg/opcodes"
+)
+
+// optimizeBodies is false if the bodies are compiled as written, without folding the known values
+var optimizeBodies = true
+
+// SetOptimize enable or disable the folding of the bodies of the languages loaded after the call
+func SetOptimize(enabled bool) {
+	optimizeBodies = enabled
+}
+
+// pushKnown a value known at compile time: the atom gets a new local, set by a constant at the end of the listing
+func (ctx *ListingContext) pushKnown(listing *[]opcodes.Opcode, status *expr.Converter, atom expr.Atom) {
+	atom = status.LabelAtom(atom)
+	ctx.knownAt[atom.Local()] = len(*listing)
+	*listing = append(*listing, opcodes.MakeIConst(atom.Local(), atom.Value()))
+	status.Push(atom)
+}
+
+// dropKnown remove the constant of a known value if it is still the last opcode of the listing, the value
+// is not read anymore once it is folded
+func (ctx *ListingContext) dropKnown(listing *[]opcodes.Opcode, atom expr.Atom) {
+	at, found := ctx.knownAt[atom.Local()]
+	if optimizeBodies && found && at == len(*listing)-1 {
+		*listing = (*listing)[:at]
+		delete(ctx.knownAt, atom.Local())
+	}
+}
+
+// fold an operation of known operands: the constants of the operands are replaced by the constant of the result,
+// so every line of the source does not compute again what is known when the language is loaded. Operation reads
+// the operands from the locals 0, 1 and writes the result after them; it is run by the VM, so the result is
+// the same of the operation run at every pass. False if an operand is not known or the VM fails the operation,
+// that is then left to the VM
+func (lang *Language) fold(fn *ListingContext, listing *[]opcodes.Opcode, status *expr.Converter, operation opcodes.Opcode, operands ...expr.Atom) bool {
+	if !optimizeBodies {
+		return false
+	}
+	run := []opcodes.Opcode{}
+	for k, a := range operands {
+		if !isKnown(a) {
+			return false
+		}
+		run = append(run, opcodes.MakeIConst(uint16(k), a.Value()))
+	}
+	v, err := lang.evaluate(append(run, operation), uint16(len(operands)))
+	if err != nil {
+		return false
+	}
+	for k := len(operands) - 1; k >= 0; k-- {
+		fn.dropKnown(listing, operands[k])
+	}
+	fn.pushKnown(listing, status, expr.MakeLiteral(operands[0].Raw(), v))
+	return true
+}
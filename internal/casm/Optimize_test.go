@@ -0,0 +1,85 @@
+package casm
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aleferri/casmvm/pkg/vmex"
+	"github.com/aleferri/casmvm/pkg/vmio"
+)
+
+// listingSizes of the bodies of the opcodes of a language, by name
+func listingSizes(t *testing.T, src string, optimize bool) map[string]int {
+	defer SetOptimize(true)
+	SetOptimize(optimize)
+	lang, err := buildTestLanguage(t, "fold", src)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sizes := map[string]int{}
+	for _, form := range lang.opcodes {
+		sizes[form.name] = len(form.runList)
+	}
+	return sizes
+}
+
+func TestFoldedBodies(t *testing.T) {
+	src := `
+.opcode IF {{ }} .with ( ) -> { .if 2 * 3 == 6 { .out [ -1 + 2 ]; } .else { .out [ 4 ]; } }
+.opcode ONE {{ }} .with ( ) -> { .out [ 1 ]; }
+.opcode ADD {{ x }} .with ( x : Ints ) -> { .out [ x + (1 + 2) ]; }
+.opcode ADD3 {{ x }} .with ( x : Ints ) -> { .out [ x + 3 ]; }
+.opcode DIV {{ }} .with ( ) -> { .out [ 1 / 0 ]; }
+`
+	plain := listingSizes(t, src, false)
+	folded := listingSizes(t, src, true)
+
+	//the known condition keeps only the taken branch, whose value is known too
+	if folded["IF"] != folded["ONE"] || plain["IF"] <= plain["ONE"] {
+		t.Errorf("Expected .if on a known condition to fold to .out [ 1 ], found %d opcodes against %d", folded["IF"], folded["ONE"])
+	}
+	if folded["ADD"] != folded["ADD3"] || plain["ADD"] <= plain["ADD3"] {
+		t.Errorf("Expected 1 + 2 to fold to 3, found %d opcodes against %d", folded["ADD"], folded["ADD3"])
+	}
+	//a division by zero is left to the VM, that reports it when the line is assembled
+	if folded["DIV"] != plain["DIV"] {
+		t.Errorf("Expected the division by zero to be kept, found %d opcodes against %d", folded["DIV"], plain["DIV"])
+	}
+}
+
+// runBody of an opcode with every parameter set to v, the result is the list of the values returned or the error
+func runBody(lang Language, op Opcode, v int64, addr int64) string {
+	frame := vmex.MakeVMFrame()
+	k := uint16(0)
+	for ; int(k) < op.ParamCount(); k++ {
+		frame.Values().Put(k, v)
+	}
+	frame.Values().Put(k, addr)
+	m := vmex.MakeInterpreter(lang.Executables(), vmio.MakeVMLoggerConsole(vmio.ALL), vmex.MakeVMFrame())
+	if err := m.Start(op.InvokeTarget(), &frame); err != nil {
+		return err.Error()
+	}
+	outs := []int64{}
+	for i := 0; i < frame.Returns().Size(); i++ {
+		outs = append(outs, frame.Returns().Peek(uint16(i)))
+	}
+	return fmt.Sprint(outs)
+}
+
+func TestOptimizedBodies(t *testing.T) {
+	defer SetOptimize(true)
+	for _, file := range []string{"evscpu/evscpu.casm", "loops/loops.casm", "inlines/order.casm", "emit/emit.casm"} {
+		SetOptimize(false)
+		plain, _ := loadTestLanguage(t, file)
+		SetOptimize(true)
+		folded, _ := loadTestLanguage(t, file)
+		for i, op := range plain.opcodes {
+			for _, v := range []int64{0, 1, 5, 0x7F, 0x1234} {
+				expected, found := runBody(plain, op, v, 0x100), runBody(folded, folded.opcodes[i], v, 0x100)
+				if expected != found {
+					t.Errorf("%s, opcode %s with %d: expected %s, found %s", file, op.name, v, expected, found)
+				}
+			}
+		}
+	}
+}
@@ -2,21 +2,23 @@ package casm
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/aleferri/casmeleon/pkg/parser"
 	"github.com/aleferri/casmeleon/pkg/text"
 )
 
 func ParseCasm(stream parser.Stream, repo text.Source) (parser.CSTNode, error) {
-	errFound := false
+	errs := MakeErrorList()
 
 	id := stream.Peek().ID()
 
 	root := parser.BuildBranch([]text.Symbol{}, ROOT_NODE)
-	var err error
 
-	for id != text.EOF && !errFound {
+	for id != text.EOF {
 		var cst parser.CSTNode
+		var err error
+		start := stream.Peek()
 
 		switch id {
 		case text.KeywordInline:
@@ -35,6 +37,30 @@ func ParseCasm(stream parser.Stream, repo text.Source) (parser.CSTNode, error) {
 			{
 				cst, err = ParseSet(stream)
 			}
+		case text.KeywordAtom, text.KeywordByte:
+			{
+				cst, err = ParseAtom(stream)
+			}
+		case text.KeywordEndian:
+			{
+				cst, err = ParseEndian(stream)
+			}
+		case text.KeywordCase:
+			{
+				cst, err = ParseCase(stream)
+			}
+		case text.KeywordConst:
+			{
+				cst, err = ParseConst(stream)
+			}
+		case text.KeywordTable:
+			{
+				cst, err = ParseTable(stream)
+			}
+		case text.KeywordInclude:
+			{
+				cst, err = ParseInclude(stream)
+			}
 		default:
 			{
 				fmt.Println(len(idDescriptor))
@@ -42,15 +68,39 @@ func ParseCasm(stream parser.Stream, repo text.Source) (parser.CSTNode, error) {
 			}
 		}
 
-		if err != nil {
-			errFound = true
-		} else {
+		if err == nil {
 			root.InsertChild(cst, true)
+		} else {
+			if _, isMatch := err.(*parser.MatchError); isMatch {
+				err = WrapMatchError(err, "\n", "\n")
+			}
+			if !errs.Add(err) {
+				break
+			}
+			resynchronize(stream, start)
 		}
 
 		id = stream.Peek().ID()
 	}
-	return root, err
+	return root, errs.orNil()
+}
+
+// declarationKeywords start a declaration of the language file, the parser restarts from one of them after an error
+var declarationKeywords = map[uint32]bool{
+	text.KeywordOpcode: true, text.KeywordInline: true, text.KeywordSet: true, text.KeywordNum: true, text.KeywordAtom: true,
+	text.KeywordByte: true, text.KeywordEndian: true, text.KeywordCase: true, text.KeywordConst: true, text.KeywordTable: true,
+	text.KeywordInclude: true,
+}
+
+// resynchronize the stream after an error in the declaration that starts at start: the symbols are skipped up
+// to the next declaration keyword, at least one symbol is skipped so that the same error is not found again
+func resynchronize(stream parser.Stream, start text.Symbol) {
+	if stream.Peek().Equals(start) {
+		stream.Next()
+	}
+	for stream.Peek().ID() != text.EOF && !declarationKeywords[stream.Peek().ID()] {
+		stream.Next()
+	}
 }
 
 // ParseNumberBase parse a number base directive
@@ -62,22 +112,158 @@ func ParseNumberBase(stream parser.Stream) (parser.CSTNode, error) {
 	return parser.BuildLeaf(seq, NUMBER_BASE), nil
 }
 
+// ParseAtom parse the declaration of the width of the atom, the smallest addressable unit: .atom bits; or .byte bits;
+func ParseAtom(stream parser.Stream) (parser.CSTNode, error) {
+	seq, err := parser.RequireSequence(stream, stream.Peek().ID(), text.Number, text.Semicolon)
+	if err != nil {
+		return nil, err
+	}
+	return parser.BuildLeaf(seq, ATOM_NODE), nil
+}
+
+// ParseEndian parse the declaration of the byte order: .endian big; or .endian little;
+func ParseEndian(stream parser.Stream) (parser.CSTNode, error) {
+	seq, err := parser.RequireSequence(stream, text.KeywordEndian, text.Identifier, text.Semicolon)
+	if err != nil {
+		return nil, err
+	}
+	return parser.BuildLeaf(seq, ENDIAN_NODE), nil
+}
+
+// ParseCase parse the case sensitivity of the language: .case sensitive; or .case insensitive [labels];
+func ParseCase(stream parser.Stream) (parser.CSTNode, error) {
+	seq, err := parser.RequireSequence(stream, text.KeywordCase, text.Identifier)
+	if err != nil {
+		return nil, err
+	}
+	if stream.Peek().ID() == text.Identifier {
+		seq = append(seq, stream.Next())
+	}
+	err = parser.Expect(stream, text.Semicolon)
+	return parser.BuildLeaf(seq, CASE_NODE), err
+}
+
+// ParseConst parse a constant of the language: .const NAME = expr;
+func ParseConst(stream parser.Stream) (parser.CSTNode, error) {
+	seq, err := parser.RequireSequence(stream, text.KeywordConst, text.Identifier, text.SymbolAssign)
+	if err != nil {
+		return nil, err
+	}
+	value, err := ParseExpression(stream)
+	if err != nil {
+		return nil, err
+	}
+	node := parser.BuildBranch(seq[:2], CONST_NODE)
+	node.InsertChild(value, true)
+	return node, parser.Expect(stream, text.Semicolon)
+}
+
+// ParseTable parse a table of constants: .table NAME { expr, expr, ... }
+func ParseTable(stream parser.Stream) (parser.CSTNode, error) {
+	seq, err := parser.RequireSequence(stream, text.KeywordTable, text.Identifier)
+	if err != nil {
+		return nil, err
+	}
+	values, err := parser.AcceptPatternWithTest(stream, text.CurlyOpen, text.CurlyClose, text.Comma, ParseExpression)
+	if err != nil {
+		return nil, err
+	}
+	node := parser.BuildBranch(seq, TABLE_NODE)
+	for _, v := range values {
+		node.InsertChild(v, true)
+	}
+	return node, nil
+}
+
+// ParseInclude parse the inclusion of another language file: .include "file.casm";
+func ParseInclude(stream parser.Stream) (parser.CSTNode, error) {
+	seq, err := parser.RequireSequence(stream, text.KeywordInclude, text.QuotedString, text.Semicolon)
+	if err != nil {
+		return nil, err
+	}
+	return parser.BuildLeaf(seq, INCLUDE_NODE), nil
+}
+
 // ParseSet parse a set of symbols
 func ParseSet(stream parser.Stream) (parser.CSTNode, error) {
 	seq, err := parser.RequireSequence(stream, text.KeywordSet, text.Identifier)
 	if err != nil {
 		return nil, err
 	}
-	after, noInset := parser.AcceptInsetPattern(stream, text.CurlyOpen, text.CurlyClose, text.Identifier, text.Semicolon)
+	switch stream.Peek().ID() {
+	case text.SymbolAssign:
+		{
+			//union: .set Name = A | B ;
+			parts, partsErr := parser.RequireSequence(stream, text.SymbolAssign, text.Identifier)
+			if partsErr != nil {
+				return nil, partsErr
+			}
+			seq = append(seq, parts...)
+			for stream.Peek().ID() == text.OperatorOr {
+				parts, partsErr = parser.RequireSequence(stream, text.OperatorOr, text.Identifier)
+				if partsErr != nil {
+					return nil, partsErr
+				}
+				seq = append(seq, parts...)
+			}
+			return parser.BuildBranch(seq, SET_NODE), parser.Expect(stream, text.Semicolon)
+		}
+	case text.Colon:
+		{
+			//subset: .set Name : Parent { members }
+			parent, parentErr := parser.RequireSequence(stream, text.Colon, text.Identifier)
+			if parentErr != nil {
+				return nil, parentErr
+			}
+			seq = append(seq, parent...)
+		}
+	case text.Identifier:
+		{
+			option := stream.Next()
+			if option.Value() != "nocase" {
+				return nil, parser.ExpectedSymbol(option, "Found unexpected token '%s', expected nocase or the %s", text.CurlyOpen)
+			}
+			seq = append(seq, option)
+		}
+	}
+	entries, noInset := parser.AcceptInsetDelegate(stream, text.CurlyOpen, text.CurlyClose, ParseSetEntry)
 	if noInset != nil {
 		return nil, noInset
 	}
-	list := parser.BuildLeaf(after, SYMBOL_SET)
 	set := parser.BuildBranch(seq, SET_NODE)
-	set.InsertChild(list, true)
+	for _, e := range entries {
+		set.InsertChild(e, true)
+	}
 	return set, nil
 }
 
+// ParseSetEntry parse the names of a member of a set with its optional value: name { , name } [ = number ] ;
+func ParseSetEntry(stream parser.Stream) (parser.CSTNode, error) {
+	first, err := parser.Require(stream, text.Identifier)
+	if err != nil {
+		return nil, err
+	}
+	syms := []text.Symbol{first}
+	for parser.Consume(stream, text.Comma) {
+		alias, aliasErr := parser.Require(stream, text.Identifier)
+		if aliasErr != nil {
+			return nil, aliasErr
+		}
+		syms = append(syms, alias)
+	}
+	if stream.Peek().ID() == text.SymbolAssign {
+		//a number, or a number with a prefix that the scanner takes for an identifier, as $FF
+		assign := stream.Next()
+		value, valueErr := parser.RequireAny(stream, text.Number, text.Identifier)
+		if valueErr != nil {
+			return nil, valueErr
+		}
+		syms = append(syms, assign, value)
+	}
+	err = parser.Expect(stream, text.Semicolon)
+	return parser.BuildLeaf(syms, SYMBOL_SET), err
+}
+
 // ParseOpcode from the source stream
 func ParseOpcode(stream parser.Stream) (parser.CSTNode, error) {
 	seq, err := parser.RequireSequence(stream, text.KeywordOpcode, text.Identifier)
@@ -159,6 +345,12 @@ func ParseInline(stream parser.Stream) (parser.CSTNode, error) {
 // ParseWithArgs after the opcode or inline declaration
 func ParseWithArgs(stream parser.Stream) (parser.CSTNode, error) {
 	arg, err := parser.RequireSequence(stream, text.Identifier, text.Colon, text.Identifier)
+	if err == nil && stream.Peek().ID() == text.SymbolAssign {
+		//default value of a parameter in an optional group: name : Set = value
+		assign := stream.Next()
+		value, valueErr := parser.RequireAny(stream, text.Number, text.Identifier)
+		arg, err = append(arg, assign, value), valueErr
+	}
 	return parser.BuildLeaf(arg, OPCODE_ARGS), err
 }
 
@@ -186,10 +378,23 @@ func ParseStatement(stream parser.Stream) (parser.CSTNode, error) {
 		return ParseOut(stream)
 	case text.KeywordReturn:
 		return ParseReturn(stream)
+	case text.KeywordLet:
+		return ParseLet(stream)
+	case text.Identifier:
+		return ParseAssign(stream)
+	case text.KeywordFor:
+		return ParseFor(stream)
+	case text.KeywordWhile:
+		return ParseWhile(stream)
+	case text.KeywordEmit:
+		return ParseEmit(stream)
+	case text.KeywordBits:
+		return ParseBits(stream)
 	}
 	return nil, parser.ExpectedAnyOf(
 		stream.Peek(), "Unexpected symbol '%s', was expecting: '%s'",
-		text.KeywordIF, text.KeywordOut, text.KeywordReturn, text.KeywordError, text.KeywordWarning,
+		text.KeywordIF, text.KeywordOut, text.KeywordReturn, text.KeywordError, text.KeywordWarning, text.KeywordLet, text.Identifier,
+		text.KeywordFor, text.KeywordWhile, text.KeywordEmit, text.KeywordBits,
 	)
 }
 
@@ -239,7 +444,7 @@ func ParseBranch(stream parser.Stream) (parser.CSTNode, error) {
 // ParseOut parse an out
 func ParseOut(stream parser.Stream) (parser.CSTNode, error) {
 	outK := stream.Next()
-	exprs, err := parser.AcceptPatternWithTest(stream, text.SquareOpen, text.SquareClose, text.Comma, ParseExpression)
+	exprs, err := parser.AcceptPatternWithTest(stream, text.SquareOpen, text.SquareClose, text.Comma, ParseOutItem)
 
 	if err != nil {
 		return nil, err
@@ -274,6 +479,219 @@ func ParseReturn(stream parser.Stream) (parser.CSTNode, error) {
 	return outNode, err
 }
 
+// ParseLet parse the declaration of a local variable: .let name = expr;
+func ParseLet(stream parser.Stream) (parser.CSTNode, error) {
+	syms, err := parser.RequireSequence(stream, text.KeywordLet, text.Identifier, text.SymbolAssign)
+	if err != nil {
+		return nil, err
+	}
+	return parseAssignedValue(stream, syms[1], STMT_LET)
+}
+
+// ParseAssign parse the assignment of a local variable: name = expr;
+func ParseAssign(stream parser.Stream) (parser.CSTNode, error) {
+	syms, err := parser.RequireSequence(stream, text.Identifier, text.SymbolAssign)
+	if err != nil {
+		return nil, err
+	}
+	return parseAssignedValue(stream, syms[0], STMT_ASSIGN)
+}
+
+func parseAssignedValue(stream parser.Stream, name text.Symbol, id uint32) (parser.CSTNode, error) {
+	expr, err := ParseExpression(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	err = parser.Expect(stream, text.Semicolon)
+
+	node := parser.BuildBranch([]text.Symbol{name}, id)
+	node.InsertChild(expr, true)
+	return node, err
+}
+
+// ParseFor parse a loop over a range: .for i in a..b [.limit n] { ... }
+func ParseFor(stream parser.Stream) (parser.CSTNode, error) {
+	syms, err := parser.RequireSequence(stream, text.KeywordFor, text.Identifier, text.Identifier)
+	if err != nil {
+		return nil, err
+	}
+	if syms[2].Value() != "in" {
+		return nil, parser.ExpectedSymbol(syms[2], "Found unexpected token '%s' after the %s of the loop, expected 'in'", text.Identifier)
+	}
+
+	//the scanner does not split on '.', so "0..8" is a single symbol
+	bounds := []text.Symbol{}
+	for stream.Peek().ID() != text.CurlyOpen && stream.Peek().ID() != text.KeywordLimit && stream.Peek().ID() != text.EOF {
+		bounds = append(bounds, stream.Next())
+	}
+	from, to, errRange := splitRange(syms[2], bounds)
+	if errRange != nil {
+		return nil, errRange
+	}
+
+	loop := parser.BuildBranch([]text.Symbol{syms[1]}, STMT_FOR)
+	loop.InsertChild(parser.BuildLeaf(from, EXPRESSION), true)
+	loop.InsertChild(parser.BuildLeaf(to, EXPRESSION), true)
+	return parseLoopBody(stream, loop)
+}
+
+// ParseWhile parse a loop with a condition: .while cond .limit n { ... }
+func ParseWhile(stream parser.Stream) (parser.CSTNode, error) {
+	err := parser.Expect(stream, text.KeywordWhile)
+	if err != nil {
+		return nil, err
+	}
+	cond, err := ParseExpression(stream)
+	if err != nil {
+		return nil, err
+	}
+	if stream.Peek().ID() != text.KeywordLimit {
+		return nil, parser.ExpectedSymbol(stream.Peek(), "Found unexpected token '%s', a .while requires '%s'", text.KeywordLimit)
+	}
+
+	loop := parser.BuildBranch([]text.Symbol{}, STMT_WHILE)
+	loop.InsertChild(cond, true)
+	return parseLoopBody(stream, loop)
+}
+
+// parseLoopBody parse the optional limit and the block of a loop, the block is inserted before the limit
+func parseLoopBody(stream parser.Stream, loop *parser.CSTBranch) (parser.CSTNode, error) {
+	var limit parser.CSTNode
+	if stream.Peek().ID() == text.KeywordLimit {
+		stream.Next()
+		var err error
+		limit, err = ParseExpression(stream)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	block, err := ParseBlock(stream)
+	if err != nil {
+		return nil, err
+	}
+	loop.InsertChild(block, true)
+	if limit != nil {
+		loop.InsertChild(limit, true)
+	}
+	return loop, nil
+}
+
+// splitRange split the symbols of a range at the '..' separator
+func splitRange(at text.Symbol, bounds []text.Symbol) ([]text.Symbol, []text.Symbol, error) {
+	for i, sym := range bounds {
+		sep := strings.Index(sym.Value(), "..")
+		if sep < 0 {
+			continue
+		}
+		from := append([]text.Symbol{}, bounds[:i]...)
+		to := []text.Symbol{}
+		if left := sym.Value()[:sep]; left != "" {
+			from = append(from, rangePart(sym, left))
+		}
+		if right := sym.Value()[sep+2:]; right != "" {
+			to = append(to, rangePart(sym, right))
+		}
+		to = append(to, bounds[i+1:]...)
+		if len(from) == 0 || len(to) == 0 {
+			return nil, nil, parser.ExpectedSymbol(sym, "Range '%s' must have both bounds, expected a %s on each side of '..'", text.Number)
+		}
+		return from, to, nil
+	}
+	return nil, nil, parser.ExpectedSymbol(at, "Found '%s' without a range, expected a %s on each side of '..'", text.Number)
+}
+
+// rangePart is the piece of a symbol on one side of '..', identified again
+func rangePart(sym text.Symbol, part string) text.Symbol {
+	return sym.WithText(part).WithID(IdentifySymbol([]rune(part), 0, 0).ID())
+}
+
+// ParseOutItem parse a value of .out or .emit, optionally with its width and byte order: expr [: bits [le|be]]
+func ParseOutItem(stream parser.Stream) (parser.CSTNode, error) {
+	expr, err := ParseExpression(stream)
+	if err != nil || stream.Peek().ID() != text.Colon {
+		return expr, err
+	}
+	stream.Next()
+	width, err := parser.Require(stream, text.Number)
+	if err != nil {
+		return nil, err
+	}
+	syms := []text.Symbol{width}
+	if stream.Peek().ID() == text.Identifier {
+		order := stream.Next()
+		if order.Value() != "le" && order.Value() != "be" {
+			return nil, parser.ExpectedSymbol(order, "Found unexpected token '%s', expected le or be after the width, or a %s", text.Comma)
+		}
+		syms = append(syms, order)
+	}
+	item := parser.BuildBranch(syms, OUT_ITEM)
+	item.InsertChild(expr, true)
+	return item, nil
+}
+
+// ParseEmit parse an .emit statement
+func ParseEmit(stream parser.Stream) (parser.CSTNode, error) {
+	err := parser.Expect(stream, text.KeywordEmit)
+	if err != nil {
+		return nil, err
+	}
+	expr, err := ParseOutItem(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	err = parser.Expect(stream, text.Semicolon)
+
+	emitNode := parser.BuildBranch([]text.Symbol{}, STMT_EMIT)
+	emitNode.InsertChild(expr, true)
+	return emitNode, err
+}
+
+// ParseBits parse the packing of fields into a word: .bits width [msb|lsb] [ expr : bits, ... ];
+func ParseBits(stream parser.Stream) (parser.CSTNode, error) {
+	syms, err := parser.RequireSequence(stream, text.KeywordBits, text.Number)
+	if err != nil {
+		return nil, err
+	}
+	if stream.Peek().ID() == text.Identifier {
+		order := stream.Next()
+		if order.Value() != "msb" && order.Value() != "lsb" {
+			return nil, parser.ExpectedSymbol(order, "Found unexpected token '%s', expected msb or lsb before the %s", text.SquareOpen)
+		}
+		syms = append(syms, order)
+	}
+
+	fields, err := parser.AcceptPatternWithTest(stream, text.SquareOpen, text.SquareClose, text.Comma, ParseBitField)
+	if err != nil {
+		return nil, err
+	}
+
+	err = parser.Expect(stream, text.Semicolon)
+
+	bitsNode := parser.BuildBranch(syms, STMT_BITS)
+	for _, f := range fields {
+		bitsNode.InsertChild(f, true)
+	}
+	return bitsNode, err
+}
+
+// ParseBitField parse a field of .bits: expr : bits
+func ParseBitField(stream parser.Stream) (parser.CSTNode, error) {
+	expr, err := ParseExpression(stream)
+	if err != nil {
+		return nil, err
+	}
+	syms, err := parser.RequireSequence(stream, text.Colon, text.Number)
+	if err != nil {
+		return nil, err
+	}
+	field := parser.BuildBranch(syms[1:], BIT_FIELD)
+	field.InsertChild(expr, true)
+	return field, nil
+}
+
 // ParseError parse an .error statement
 func ParseError(stream parser.Stream) (parser.CSTNode, error) {
 	syms, err := parser.RequireSequence(stream, text.KeywordError, text.Identifier, text.Comma, text.QuotedString, text.Semicolon)
@@ -313,6 +731,9 @@ func parseTerm(stream parser.Stream, expr []text.Symbol) ([]text.Symbol, error)
 	switch t.ID() {
 	case text.Number, text.Identifier:
 		{
+			if t.Value() == ".len" {
+				return parseTerm(stream, append(expr, t))
+			}
 			return append(expr, t), nil
 		}
 	case text.RoundOpen:
@@ -11,6 +11,7 @@ import (
 type ParserError struct {
 	wrapped *parser.MatchError
 	context text.MessageContext
+	notes   []string
 }
 
 func (e *ParserError) Error() string {
@@ -24,6 +25,29 @@ func (e *ParserError) PrettyPrint(source *text.Source) {
 	fmt.Printf(e.wrapped.Error(), wrong.Value(), e.wrapped.Expected().StringFromArray(idDescriptor))
 	fmt.Println()
 	source.PrintContext(e.context)
+	for _, note := range e.notes {
+		fmt.Println(note)
+	}
+}
+
+//FileIndex of the file where the error was found
+func (e *ParserError) FileIndex() uint32 {
+	return e.wrapped.Found().FileIndex()
+}
+
+//At is the symbol where the error was found
+func (e *ParserError) At() text.Symbol {
+	return e.wrapped.Found()
+}
+
+//AddNote to be printed after the context of the error
+func (e *ParserError) AddNote(note string) {
+	e.notes = append(e.notes, note)
+}
+
+//Notes printed after the context of the error
+func (e *ParserError) Notes() []string {
+	return e.notes
 }
 
 //WrapError of underlying match
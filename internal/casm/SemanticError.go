@@ -0,0 +1,94 @@
+package casm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aleferri/casmeleon/pkg/parser"
+	"github.com/aleferri/casmeleon/pkg/text"
+)
+
+// SemanticError is an error in the meaning of a language file, found at a symbol of the file
+type SemanticError struct {
+	at      text.Symbol
+	message string
+	scopes  []string //declarations and statements that enclose the error, outermost first
+}
+
+// semanticError at the specified symbol
+func semanticError(at text.Symbol, message string) *SemanticError {
+	return &SemanticError{at: at, message: message, scopes: []string{}}
+}
+
+// semanticErrorf at the specified symbol, with a formatted message
+func semanticErrorf(at text.Symbol, format string, args ...interface{}) *SemanticError {
+	return semanticError(at, fmt.Sprintf(format, args...))
+}
+
+// errorAt give a position to an error that has none, an error with a position keeps it
+func errorAt(err error, at text.Symbol) error {
+	if err == nil {
+		return nil
+	}
+	if _, positioned := err.(*SemanticError); positioned {
+		return err
+	}
+	return semanticError(at, err.Error())
+}
+
+// errorIn record that the error was found inside scope, the position of the error is kept
+func errorIn(err error, scope string) error {
+	semErr, positioned := err.(*SemanticError)
+	if !positioned {
+		return fmt.Errorf("In %s:\n%s", scope, err.Error())
+	}
+	semErr.scopes = append([]string{scope}, semErr.scopes...)
+	return semErr
+}
+
+func (e *SemanticError) Error() string {
+	var sb strings.Builder
+	for _, scope := range e.scopes {
+		sb.WriteString("In " + scope + ":\n")
+	}
+	sb.WriteString(e.message)
+	return sb.String()
+}
+
+// Message of the error, without the enclosing scopes
+func (e *SemanticError) Message() string {
+	return e.message
+}
+
+// At is the symbol where the error was found
+func (e *SemanticError) At() text.Symbol {
+	return e.at
+}
+
+// FileIndex of the file where the error was found
+func (e *SemanticError) FileIndex() uint32 {
+	return e.at.FileIndex()
+}
+
+// PrettyPrint the error with its position and the line of the source that contains it
+func (e *SemanticError) PrettyPrint(source *text.Source) {
+	fileName, lineIndex, column := source.FindPosition(e.at)
+	fmt.Printf("In file %s, error at %d, %d: %s\n", fileName, lineIndex+1, column+1, e.message)
+	for _, scope := range e.scopes {
+		fmt.Println("    in " + scope)
+	}
+	source.PrintContext(text.MakeMessageContext(e.at, "\n", "\n"))
+}
+
+// firstSymbol of a node, the statements without symbols of their own take the first symbol of their children
+func firstSymbol(node parser.CSTNode) text.Symbol {
+	if syms := node.Symbols(); len(syms) > 0 {
+		return syms[0]
+	}
+	for _, k := range node.Children() {
+		if sym := firstSymbol(k); sym.ID() != text.NONE {
+			return sym
+		}
+	}
+	return text.Symbol{}
+}
@@ -0,0 +1,58 @@
+package casm
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/aleferri/casmeleon/pkg/text"
+)
+
+func TestSemanticErrorPositions(t *testing.T) {
+	cases := []struct {
+		name    string
+		src     string
+		line    uint32
+		column  uint32
+		message string
+	}{
+		{"parameter", ".opcode X {{ # n }}\n.with ( n : Ints ) -> {\n    .out [ n + m ];\n}\n", 3, 16, "Parameter m not found"},
+		{"set", ".opcode X {{ r }}\n.with ( r : Regs ) -> {\n    .out [ r ];\n}\n", 2, 13, "Set Regs do not exists"},
+		{"member", ".set Regs {\n    A;\n    A;\n}\n", 3, 5, "Duplicate member A"},
+		{"inline", ".opcode X {{ }}\n.with ( ) -> {\n    .out [ .expr F ( 1 ) ];\n}\n", 3, 18, "Cannot find function F"},
+		{"const", ".const A = 1;\n.const A = 2;\n", 2, 8, "Constant A is already declared"},
+		{"arity", ".inline F\n.with ( a : Ints ) -> {\n    .return a;\n}\n.opcode X {{ }}\n.with ( ) -> {\n    .out [ .expr F ( 1, 2 ) ];\n}\n", 7, 18,
+			"Inline F has 1 parameter(s), it is called with 2 argument(s)"},
+		{"recursion", ".inline F\n.with ( a : Ints ) -> {\n    .return .expr G ( a );\n}\n.inline G\n.with ( a : Ints ) -> {\n    .return .expr F ( a );\n}\n", 7, 19,
+			"Recursive call of inline F: F -> G -> F"},
+		{"argument member", ".set Regs { A; B; }\n.set Ports { P; }\n.inline F\n.with ( r : Regs ) -> {\n    .return r;\n}\n.opcode X {{ }}\n.with ( ) -> {\n    .out [ .expr F ( P ) ];\n}\n", 9, 18,
+			"Argument P of inline F is not a member of Regs"},
+		{"argument set", ".set Regs { A; B; }\n.set Ports { P; }\n.inline F\n.with ( r : Regs ) -> {\n    .return r;\n}\n.opcode X {{ p }}\n.with ( p : Ports ) -> {\n    .out [ .expr F ( p ) ];\n}\n", 9, 18,
+			"Argument p of inline F is a member of Ports"},
+		{"64 bits", ".num 16 \"0x\" \"\"\n.const A = 0x1_0000_0000_0000_0000;\n", 2, 12, "Number 0x1_0000_0000_0000_0000 does not fit in 64 bits"},
+		{"separator", ".const A = 1__0;\n", 1, 12, "Invalid number 1__0"},
+		{"base", ".num 40 \"q\" \"\"\n", 1, 6, "The base of .num must be between 2 and 36, found 40"},
+	}
+	for _, c := range cases {
+		repo := text.BuildSource(c.name)
+		root, parseErr := ParseCasm(BuildStream(bufio.NewReader(strings.NewReader(c.src)), &repo), repo)
+		if parseErr != nil {
+			t.Fatalf("%s: %s", c.name, parseErr.Error())
+		}
+		_, err := MakeLanguage(root, 8)
+		list, ok := err.(*ErrorList)
+		if !ok {
+			t.Errorf("%s: expected a list of errors, found %v", c.name, err)
+			continue
+		}
+		semErr, ok := list.Errors()[0].(*SemanticError)
+		if !ok {
+			t.Errorf("%s: expected a semantic error, found %v", c.name, err)
+			continue
+		}
+		_, line, column := repo.FindPosition(semErr.At())
+		if line+1 != c.line || column+1 != c.column || !strings.Contains(semErr.Message(), c.message) {
+			t.Errorf("%s: expected '%s' at %d, %d, found '%s' at %d, %d", c.name, c.message, c.line, c.column, semErr.Message(), line+1, column+1)
+		}
+	}
+}
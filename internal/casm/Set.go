@@ -1,7 +1,11 @@
 package casm
 
 import (
+	"math"
+	"strings"
+
 	"github.com/aleferri/casmeleon/pkg/parser"
+	"github.com/aleferri/casmeleon/pkg/text"
 )
 
 //Set of a symbol
@@ -9,6 +13,9 @@ type Set struct {
 	name    string
 	index   uint32
 	valueOf func(string) int32
+	members map[string]int32 //declared members, nil for the builtin sets
+	values  []int32          //values of the members in order of declaration, each one once
+	noCase  bool
 }
 
 //Contains the specified symbol
@@ -30,25 +37,163 @@ func (s *Set) ID() uint32 {
 	return s.index
 }
 
-func generateFindValue(list []string) func(string) int32 {
+//generateLookup of the members of a set, the names are lower case if noCase
+func generateLookup(members map[string]int32, noCase bool) func(string) int32 {
 	return func(str string) int32 {
-		for i, s := range list {
-			if s == str {
-				return int32(i)
-			}
+		if noCase {
+			str = strings.ToLower(str)
+		}
+		if v, found := members[str]; found {
+			return v
 		}
 		return -1
 	}
 }
 
-//PruneToSet reduce the Concrete Syntax Tree Branch of a Set declaration to a type
-func PruneToSet(node parser.CSTNode, index uint32) Set {
-	name := node.Symbols()[1]
-	values := []string{}
-	leafs := node.Children()
-	items := leafs[0].Symbols()
-	for i := 0; i < len(items); i += 2 {
-		values = append(values, items[i].Value())
+//makeSet from its members, the names are lower case if noCase
+func makeSet(name string, index uint32, members map[string]int32, values []int32, noCase bool) Set {
+	return Set{name: name, index: index, valueOf: generateLookup(members, noCase), members: members, values: values, noCase: noCase}
+}
+
+//appendValue to the values of a set, if it is not already there
+func appendValue(values []int32, v int32) []int32 {
+	for _, old := range values {
+		if old == v {
+			return values
+		}
+	}
+	return append(values, v)
+}
+
+//PruneToSet reduce the Concrete Syntax Tree Branch of a Set declaration to a type.
+//The set is a list of members, a subset of a declared set or the union of declared sets
+func PruneToSet(lang *Language, node parser.CSTNode, index uint32) (Set, error) {
+	syms := node.Symbols()
+	if len(syms) > 2 && syms[2].ID() == text.Colon {
+		return pruneToSubset(lang, node, index)
+	}
+	if len(syms) > 2 && syms[2].ID() == text.SymbolAssign {
+		return pruneToUnion(lang, node, index)
+	}
+	return pruneToMembers(lang, node, index)
+}
+
+//pruneToMembers of a set, the names match in any case if the language is case insensitive. A member without an explicit value takes the value of the previous entry plus one,
+//starting from 0; all the names of an entry are aliases of the same value
+func pruneToMembers(lang *Language, node parser.CSTNode, index uint32) (Set, error) {
+	syms := node.Symbols()
+	name := syms[1].Value()
+	noCase := lang.noCase || len(syms) > 2
+
+	members := map[string]int32{}
+	values := []int32{}
+	next := int64(0)
+	for _, entry := range node.Children() {
+		names := entry.Symbols()
+		value := next
+		for i, s := range names {
+			if s.ID() != text.SymbolAssign {
+				continue
+			}
+			v, err := lang.parseNumber(names[i+1].Value())
+			if err != nil {
+				return Set{}, semanticError(names[i+1], "Invalid value "+names[i+1].Value()+" for "+names[0].Value()+" in set "+name)
+			}
+			value = v
+			names = names[:i]
+			break
+		}
+		if value < 0 || value > math.MaxInt32 {
+			return Set{}, semanticErrorf(names[0], "The value of %s in set %s must be between 0 and %d, found %d", names[0].Value(), name, math.MaxInt32, value)
+		}
+		for _, n := range names {
+			key := n.Value()
+			if noCase {
+				key = strings.ToLower(key)
+			}
+			if _, found := members[key]; found {
+				return Set{}, semanticError(n, "Duplicate member "+n.Value()+" in set "+name)
+			}
+			members[key] = int32(value)
+		}
+		values = appendValue(values, int32(value))
+		next = value + 1
+	}
+	return makeSet(name, index, members, values, noCase), nil
+}
+
+//declaredSet used to build another set, the builtin sets have no members to take
+func declaredSet(lang *Language, symbol text.Symbol, name string) (*Set, error) {
+	parent, found := lang.SetByName(symbol.Value())
+	if !found {
+		return nil, semanticError(symbol, "Set "+symbol.Value()+" used by set "+name+" do not exists")
+	}
+	if parent.members == nil {
+		return nil, semanticError(symbol, "Set "+name+" cannot be built from the builtin set "+symbol.Value())
+	}
+	return parent, nil
+}
+
+//pruneToSubset of a set: the members keep the values they have in the parent
+func pruneToSubset(lang *Language, node parser.CSTNode, index uint32) (Set, error) {
+	syms := node.Symbols()
+	name := syms[1].Value()
+	parent, err := declaredSet(lang, syms[3], name)
+	if err != nil {
+		return Set{}, err
+	}
+
+	members := map[string]int32{}
+	values := []int32{}
+	for _, entry := range node.Children() {
+		for _, n := range entry.Symbols() {
+			if n.ID() == text.SymbolAssign {
+				return Set{}, semanticError(n, "The members of the subset "+name+" take their values from "+parent.name)
+			}
+			v := parent.valueOf(n.Value())
+			if v < 0 {
+				return Set{}, semanticError(n, n.Value()+" of the subset "+name+" is not a member of "+parent.name)
+			}
+			key := n.Value()
+			if parent.noCase {
+				key = strings.ToLower(key)
+			}
+			if _, found := members[key]; found {
+				return Set{}, semanticError(n, "Duplicate member "+n.Value()+" in set "+name)
+			}
+			members[key] = v
+			values = appendValue(values, v)
+		}
+	}
+	return makeSet(name, index, members, values, parent.noCase), nil
+}
+
+//pruneToUnion of sets: a name in more than one set must have the same value in all of them
+func pruneToUnion(lang *Language, node parser.CSTNode, index uint32) (Set, error) {
+	syms := node.Symbols()
+	name := syms[1].Value()
+
+	members := map[string]int32{}
+	values := []int32{}
+	noCase := false
+	for i := 3; i < len(syms); i += 2 {
+		part, err := declaredSet(lang, syms[i], name)
+		if err != nil {
+			return Set{}, err
+		}
+		if i > 3 && part.noCase != noCase {
+			return Set{}, semanticError(syms[i], "The union "+name+" mixes nocase sets and case sensitive sets")
+		}
+		noCase = part.noCase
+		for k, v := range part.members {
+			if old, found := members[k]; found && old != v {
+				return Set{}, semanticErrorf(syms[i], "%s is %d in a set and %d in %s, the union %s is ambiguous", k, old, v, part.name, name)
+			}
+			members[k] = v
+		}
+		for _, v := range part.values {
+			values = appendValue(values, v)
+		}
 	}
-	return Set{name: name.Value(), index: index, valueOf: generateFindValue(values)}
+	return makeSet(name, index, members, values, noCase), nil
 }
@@ -0,0 +1,66 @@
+package casm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aleferri/casmeleon/pkg/text"
+)
+
+// Signal is an .error or a .warning statement. The VM only reports the message, so the statement is
+// recorded at compile time to trace the message back to the operand that caused it.
+type Signal struct {
+	message string      //message as written in the .casm file
+	symbol  text.Symbol //identifier after .error or .warning
+	param   int         //index of the identifier in the parameters, -1 if it is not a parameter
+	fatal   bool        //.error if true, .warning otherwise
+	id      int         //index of the statement in the language, unique even if the messages are equal
+	origin  string      //inline of the statement, empty if it is in the body of the opcode
+}
+
+// Message of the signal as written in the language file
+func (s Signal) Message() string {
+	return s.message
+}
+
+// Param is the index of the parameter reported by the signal, -1 if the signal does not report a parameter
+func (s Signal) Param() int {
+	return s.param
+}
+
+// IsError is true for .error, false for .warning
+func (s Signal) IsError() bool {
+	return s.fatal
+}
+
+// Origin is the inline of the statement, empty if the statement is in the body of the opcode
+func (s Signal) Origin() string {
+	return s.origin
+}
+
+// vmText of an .error, the message given to the VM: the index of the statement follows the message, so
+// that the error is traced back to its statement even if another one has the same message
+func (s Signal) vmText() string {
+	return fmt.Sprintf("%s #%d, value ", s.message, s.id)
+}
+
+// FindSignal return the signal that raised an error reported by the VM, and the value reported with it
+func FindSignal(signals []Signal, reported string, fatal bool) (Signal, int64, bool) {
+	for _, s := range signals {
+		if s.fatal != fatal {
+			continue
+		}
+		at := strings.Index(reported, s.vmText())
+		if at < 0 {
+			continue
+		}
+		digits := strings.Fields(reported[at+len(s.vmText()):] + " ")
+		value := int64(0)
+		if len(digits) > 0 {
+			value, _ = strconv.ParseInt(digits[0], 10, 64)
+		}
+		return s, value, true
+	}
+	return Signal{}, 0, false
+}
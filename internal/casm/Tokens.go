@@ -45,7 +45,10 @@ var identifyMap = map[string]uint32{
 	"^": text.OperatorXor, "!": text.OperatorNot, "~": text.OperatorNeg, "<": text.OperatorLess, "<=": text.OperatorLessEqual,
 	"==": text.OperatorEqual, ">=": text.OperatorGreaterEqual, ">": text.OperatorGreater, "!=": text.OperatorNotEqual, ".atom": text.KeywordAtom,
 	"<<": text.OperatorLeftShift, ">>": text.OperatorRightShift, "->": text.SymbolArrow, "#": text.SymbolHash, "@": text.SymbolHash,
-	"{{": text.DoubleCurlyOpen, "}}": text.DoubleCurlyClose, ".return": text.KeywordReturn, "{": text.CurlyOpen, "}": text.CurlyClose,
+	"{{": text.DoubleCurlyOpen, "}}": text.DoubleCurlyClose, ".return": text.KeywordReturn, ".let": text.KeywordLet, "=": text.SymbolAssign,
+	".for": text.KeywordFor, ".while": text.KeywordWhile, ".limit": text.KeywordLimit, ".emit": text.KeywordEmit, ".bits": text.KeywordBits, ".endian": text.KeywordEndian, ".byte": text.KeywordByte, ".case": text.KeywordCase, ".opt": text.KeywordOpt,
+	".const": text.KeywordConst, ".table": text.KeywordTable, ".include": text.KeywordInclude,
+	"{": text.CurlyOpen, "}": text.CurlyClose,
 	"(": text.RoundOpen, ")": text.RoundClose, "[": text.SquareOpen, "]": text.SquareClose, ";": text.Semicolon, ":": text.Colon, ",": text.Comma,
 }
 
@@ -54,7 +57,8 @@ var idDescriptor = []string{
 	"@", "#", "->", "/*", "*/", "//", "Quoted String", "Quoted Char", "Unary +", "+", "Unary -", "-", "*", "/", "%", ">>", "<<", "&", "&&",
 	"|", "||", "^", "!", "~", "<", "==", "<=", ">=", ">", "!=", ".if Keyword", ".else Keyword", ".out Keyword", ".outr Keyword", ".set Keyword",
 	".num Keyword", ".atom Keyword", ".inline Keyword", ".opcode Keyword", ".with Keyword", ".expr Keyword", ".warning Keyword", ".error Keyword",
-	".return Keyword", "number", "identifier", "text label", "Errore di fuori indice",
+	".return Keyword", ".let Keyword", "=", ".for Keyword", ".while Keyword", ".limit Keyword",
+	".emit Keyword", ".bits Keyword", ".endian Keyword", ".byte Keyword", ".case Keyword", ".opt Keyword", ".const Keyword", ".table Keyword", ".include Keyword", "number", "identifier", "text label", "Errore di fuori indice",
 }
 
 var temporaryTokenMarks = map[int32]int32{1: 1, 2: 2, 3: 3, 4: 5}
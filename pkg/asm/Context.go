@@ -7,4 +7,6 @@ type Context interface {
 	Refresh(sym Symbol)
 	RetryList() []RetryQueue
 	ByteSize() uint32
+	BeginPass(pass int)
+	Pass() int
 }
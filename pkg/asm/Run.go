@@ -11,8 +11,9 @@ type BinaryImage struct {
 	content []uint8
 }
 
-//maxPasses caps the fixed point search: with automatic short/long form
-//selection a pathological source can oscillate instead of converging
+//maxPasses caps the fixed point search. Automatic short/long form selection
+//is monotone (an item never shrinks after growing), so the sizes can only grow
+//and a source converges; the cap is a guard against an item that breaks it
 const maxPasses = 10
 
 //AssembleSource assembles the list until the addresses stop moving.
@@ -43,6 +44,7 @@ func AssembleSource(m opcodes.VM, list []Compilable, ctx Context) ([]uint8, erro
 			}
 		}
 		ctx.ClearAll()
+		ctx.BeginPass(pass + 1)
 
 		work := 0
 		addr := uint32(0)
@@ -5,10 +5,11 @@ import "sort"
 type SourceContext struct {
 	guards   map[string]RetryQueue
 	byteSize uint32
+	pass     int
 }
 
 func MakeSourceContext(byteSize uint32) *SourceContext {
-	return &SourceContext{map[string]RetryQueue{}, byteSize}
+	return &SourceContext{map[string]RetryQueue{}, byteSize, 0}
 }
 
 func (ctx *SourceContext) EnsureExists(name string) RetryQueue {
@@ -60,3 +61,13 @@ func (ctx *SourceContext) RetryList() []RetryQueue {
 func (ctx *SourceContext) ByteSize() uint32 {
 	return ctx.byteSize
 }
+
+//BeginPass is called by AssembleSource at the start of every pass, counting from 1
+func (ctx *SourceContext) BeginPass(pass int) {
+	ctx.pass = pass
+}
+
+//Pass in progress, 0 before the first one
+func (ctx *SourceContext) Pass() int {
+	return ctx.pass
+}
@@ -6,7 +6,7 @@ import "math"
 type Atom struct {
 	raw   string //raw atom
 	val   int64  //value of the atom, if it has one, default is 0
-	tag   int16  //tag of the atom (0: literal, 1: parameter, 2: set member)
+	tag   int16  //tag of the atom (0: literal, 1: parameter, 2: set member, 3: local, 4: table, 5: set)
 	local uint16 //local index of this atom, default is MAX_UINT16
 }
 
@@ -14,6 +14,10 @@ func (a Atom) Tag() int16 {
 	return a.tag
 }
 
+func (a Atom) Raw() string {
+	return a.raw
+}
+
 func (a Atom) Local() uint16 {
 	return a.local
 }
@@ -41,3 +45,13 @@ func MakeMember(raw string, val int64) Atom {
 func MakeLocal(raw string, val int64, local uint16) Atom {
 	return Atom{raw, val, 3, local}
 }
+
+//MakeTable is a reference to a table, index is the position of the table in the language
+func MakeTable(raw string, index int64) Atom {
+	return Atom{raw, index, 4, math.MaxUint16}
+}
+
+//MakeSet is a reference to a set, index is the id of the set in the language
+func MakeSet(raw string, index int64) Atom {
+	return Atom{raw, index, 5, math.MaxUint16}
+}
@@ -2,6 +2,7 @@ package text
 
 import (
 	"fmt"
+	"strings"
 	"unicode/utf8"
 )
 
@@ -10,6 +11,10 @@ type Source struct {
 	fileName  string
 	fileIndex uint32
 	symbols   []Symbol
+	lines     []uint32 //line of every symbol, in the same order
+	columns   []uint32 //column of every symbol, in the same order
+	line      uint32   //line where the next symbol starts
+	column    uint32   //column where the next symbol starts
 }
 
 //BuildSource archive for error reporting
@@ -17,6 +22,16 @@ func BuildSource(fileName string) Source {
 	return Source{fileName: fileName, fileIndex: 0, symbols: []Symbol{}}
 }
 
+//BuildIndexedSource archive for one of the files of a group, fileIndex tells the files apart
+func BuildIndexedSource(fileName string, fileIndex uint32) Source {
+	return Source{fileName: fileName, fileIndex: fileIndex, symbols: []Symbol{}}
+}
+
+//FileName of the Source
+func (s *Source) FileName() string {
+	return s.fileName
+}
+
 //Count the available symbols
 func (s *Source) Count() uint32 {
 	return uint32(len(s.symbols))
@@ -30,24 +45,33 @@ func (s *Source) FileIndex() uint32 {
 //Append symbol to the Source
 func (s *Source) Append(sym Symbol) {
 	s.symbols = append(s.symbols, sym)
+	s.lines = append(s.lines, s.line)
+	s.columns = append(s.columns, s.column)
+
+	//comments are whitespace symbols that swallow the end of the line,
+	//so the lines are counted on the text and not on the EOL symbols
+	lastBreak := strings.LastIndex(sym.value, "\n")
+	if lastBreak < 0 {
+		s.column += uint32(len(sym.value))
+	} else {
+		s.line += uint32(strings.Count(sym.value, "\n"))
+		s.column = uint32(len(sym.value) - lastBreak - 1)
+	}
 }
 
 //FindPosition of a symbol inside the source
 func (s *Source) FindPosition(sym Symbol) (string, uint32, uint32) {
-	line := uint32(0)
-	offset := uint32(0)
-	for _, t := range s.symbols {
+	//symbols are numbered in order of appending, so the offset is the index
+	index := sym.symOffset
+	if index < uint32(len(s.symbols)) && s.symbols[index].symOffset == sym.symOffset {
+		return s.fileName, s.lines[index], s.columns[index]
+	}
+	for i, t := range s.symbols {
 		if t.symOffset == sym.symOffset {
-			return s.fileName, line, offset
-		}
-		if t.symID == EOL {
-			line++
-			offset = 0
-		} else {
-			offset += uint32(len(t.value))
+			return s.fileName, s.lines[i], s.columns[i]
 		}
 	}
-	return s.fileName, line, offset
+	return s.fileName, s.line, s.column
 }
 
 //SliceLine return the Line sourrounding the symbol
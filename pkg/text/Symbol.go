@@ -71,6 +71,20 @@ const (
 	KeywordWarning
 	KeywordError
 	KeywordReturn
+	KeywordLet
+	SymbolAssign
+	KeywordFor
+	KeywordWhile
+	KeywordLimit
+	KeywordEmit
+	KeywordBits
+	KeywordEndian
+	KeywordByte
+	KeywordCase
+	KeywordOpt
+	KeywordConst
+	KeywordTable
+	KeywordInclude
 	Number
 	Identifier
 	ExactMatchKeyword
@@ -98,6 +112,11 @@ func (s Symbol) WithText(text string) Symbol {
 	return s
 }
 
+//FileIndex of the Source the Symbol was read from
+func (s Symbol) FileIndex() uint32 {
+	return s.fileOffset
+}
+
 //ID is the identifier of the Symbol
 func (s Symbol) ID() uint32 {
 	return s.symID
@@ -0,0 +1,4 @@
+        MOV     CX, #0x1234
+        MOVD    BX, #0x11223344
+        JMP     0x0A0B0C
+        PUSH    #0x5566
@@ -0,0 +1 @@
+        LDI     #0xAABBCCDD
@@ -0,0 +1,4 @@
+        LDA     high        ; zero page in the first pass, absolute in the second
+        PAD                 ; long in the first pass, only the short form succeeds in the second
+        .advance 0x0120
+high:   NOP
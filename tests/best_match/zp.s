@@ -0,0 +1,6 @@
+        LDA     low         ; zero page
+        LDA     high        ; absolute
+        LDA     0x10        ; zero page
+low:    NOP
+        .advance 0x0120
+high:   NOP
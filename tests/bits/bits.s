@@ -0,0 +1,3 @@
+        ADDI    x1, x2, -4
+        ADDL    x1, x2, -4
+        ADDWF   0x25, 1
@@ -0,0 +1 @@
+        ADDI    x1, x2, 5000
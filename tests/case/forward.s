@@ -0,0 +1,3 @@
+        GO      END
+        .advance 0x10
+end:    GO      End
@@ -0,0 +1,6 @@
+Start:  lda     #0X1F
+        LDA     #0x20
+        Lda     #101B
+        trn     y
+        TRN     X
+        jmp     START
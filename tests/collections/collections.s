@@ -0,0 +1,4 @@
+        TST     A
+        TST     Y
+        SZ      #1
+        SZ      #2
@@ -0,0 +1,4 @@
+        JR      NZ, 0x10
+        JR      C, 0x11
+        JP      Z, 0x12
+        SQ      #5
@@ -0,0 +1 @@
+        SQ      #6
@@ -0,0 +1,5 @@
+        MOV     BX, [DS + 0]
+        MOV     CX, [ES + 5]
+        MOV     AX, [CS + 0x1234]
+        PUSH    SS
+        PUSH    DS
@@ -0,0 +1,3 @@
+        NOP
+        BIT     #$12
+        PHX
@@ -0,0 +1,9 @@
+        NOP
+        FOO     #1
+        BIT     #$12, X
+        JMPX    there
+start:  NOP
+        BIT     #missing
+        BIT     #missing
+        BIT     #other
+        NOPE
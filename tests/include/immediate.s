@@ -0,0 +1 @@
+        BIT     #$12
@@ -0,0 +1,4 @@
+INC C
+INC E
+PUSH DE
+LDB #0x12
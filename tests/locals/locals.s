@@ -0,0 +1,5 @@
+start:  MOV     R1, R2
+        MOV     R3, R3
+        BR      start
+        BR      next
+next:   MOV     R0, R1
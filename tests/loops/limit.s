@@ -0,0 +1 @@
+        FILL    5, 0xEE
@@ -0,0 +1,5 @@
+        PUSH    0b10000101
+        ULEB    #300
+        ULEB    #5
+        FILL    3, 0xEE
+        PAIRS
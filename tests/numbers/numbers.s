@@ -0,0 +1,4 @@
+        MASKED  #$12345678
+        WRAP
+        IN      MEM
+        IN      IO, 3
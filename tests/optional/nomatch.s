@@ -0,0 +1,2 @@
+        LD      A, ( IX - 1 )
+        RETT
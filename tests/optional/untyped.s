@@ -0,0 +1 @@
+        MOV     A, X
@@ -0,0 +1,7 @@
+        RET
+        RET     Z
+        LD      A, (IX)
+        LD      A, (IY + 5)
+        JP      [0x10]
+        JP      [0x10 + 2]
+        JP      [0x10 + 2 * 3]
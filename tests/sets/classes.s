@@ -0,0 +1,5 @@
+        MOV     R1, R2
+        MOV     R5, R2
+        MOV     SP, R7
+        PUSH    R1
+        PUSH    R6
@@ -0,0 +1,6 @@
+        PUSH    R1
+        PUSH    sp
+        PUSH    R13
+        PUSH    lr
+        PUSH    Pc
+        MOVSP   R2
@@ -0,0 +1,4 @@
+        LDA C
+        LDX C
+        LDA B
+        LDX X
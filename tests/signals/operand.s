@@ -0,0 +1 @@
+        ADD     1, 300
@@ -0,0 +1,4 @@
+        LD      #0
+        LD      #0x1FF
+        LD      #3
+        RET